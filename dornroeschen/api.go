@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// runRequest asks the main loop to run a job.
+type runRequest struct {
+	job   string   // run, backup, sync or retry (failed backups)
+	hosts []string // for job == backup, empty means all -backup_hosts
+
+	// schedule is the name of the schedule which triggered the run, if any.
+	schedule string
+}
+
+func (r runRequest) String() string {
+	s := r.job
+	if r.job == "backup" && len(r.hosts) > 0 {
+		s = "backup of " + strings.Join(r.hosts, ", ")
+	}
+	if r.schedule != "" {
+		s += " (schedule " + r.schedule + ")"
+	}
+	return s
+}
+
+type httpErr struct {
+	code int
+	err  error
+}
+
+func (h *httpErr) Error() string {
+	return h.err.Error()
+}
+
+func httpError(code int, err error) error {
+	return &httpErr{code, err}
+}
+
+func handleError(h func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		if err == context.Canceled {
+			return // client canceled the request
+		}
+		code := http.StatusInternalServerError
+		unwrapped := err
+		if he, ok := err.(*httpErr); ok {
+			code = he.code
+			unwrapped = he.err
+		}
+		log.Printf("%s: HTTP %d %s", r.URL.Path, code, unwrapped)
+		http.Error(w, unwrapped.Error(), code)
+	})
+}
+
+// backupSource returns the -backup_hosts (or -opportunistic_backup_hosts)
+// entry for host.
+func backupSource(host string) (string, bool) {
+	for _, entry := range strings.Split(*backupHosts, ",") {
+		if h, _ := splitHostMAC(entry); h == host {
+			return entry, true
+		}
+	}
+	for _, h := range strings.Split(*opportunisticBackupHosts, ",") {
+		if strings.TrimSpace(h) == host {
+			return host + "/", true
+		}
+	}
+	return "", false
+}
+
+var statusTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <title>dornröschen</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta http-equiv="refresh" content="10">
+  <style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2rem 0.6rem; text-align: left; }
+.failed { color: #c00; }
+.canceled { color: #a60; }
+.done { color: #080; }
+  </style>
+</head>
+<body>
+<h1>dornröschen</h1>
+<p>
+{{ with .Run }}
+{{ if .Running }}
+Running <strong>{{ .Job }}</strong> since {{ .Start.Format "2006-01-02 15:04:05" }}.
+<form method="post" action="/cancel" style="display: inline"><button>cancel</button></form>
+{{ else if .Job }}
+Idle. Last job: <strong>{{ .Job }}</strong>, {{ .Start.Format "2006-01-02 15:04:05" }} – {{ .End.Format "15:04:05" }}{{ if .CancelReason }}, <span class="canceled">canceled: {{ .CancelReason }}</span>{{ else if .Error }}, <span class="failed">{{ .Error }}</span>{{ end }}.
+{{ else }}
+Idle.
+{{ end }}
+{{ end }}
+</p>
+
+<form method="post" action="/run" style="display: inline"><button>full run</button></form>
+<form method="post" action="/sync" style="display: inline"><button>sync only</button></form>
+<form method="post" action="/retry" style="display: inline"><button>retry failed backups</button></form>
+<form method="post" action="/backup" style="display: inline">
+  <input name="host" placeholder="host" required>
+  <button>backup host</button>
+</form>
+
+<table>
+<tr><th>kind</th><th>source</th><th>destination</th><th>phase</th><th>since</th><th>output</th></tr>
+{{ range .Tasks }}
+<tr>
+  <td>{{ .Kind }}</td>
+  <td>{{ .Source }}</td>
+  <td>{{ .Destination }}</td>
+  <td class="{{ .Phase }}">{{ .Phase }}{{ if .Error }}: {{ .Error }}{{ end }}</td>
+  <td>{{ .Since.Format "2006-01-02 15:04:05" }}</td>
+  <td><a href="/output?id={{ .ID }}">output</a></td>
+</tr>
+{{ end }}
+</table>
+
+<h2>schedules</h2>
+<table>
+<tr><th>name</th><th>job</th><th>cron</th><th>last run</th><th>next run</th></tr>
+{{ range .Schedules }}
+<tr>
+  <td>{{ .Name }}</td>
+  <td>{{ .Job }}</td>
+  <td><code>{{ .Cron }}</code></td>
+  <td>{{ if not .Last.IsZero }}{{ .Last.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+  <td>{{ if not .Next.IsZero }}{{ .Next.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+</tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+func handleStatusPage(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/" {
+		return httpError(http.StatusNotFound, fmt.Errorf("not found"))
+	}
+	return statusTmpl.Execute(w, currentStatus())
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(currentStatus())
+}
+
+// handleOutput streams the SSH/rsync output of a task until the task is done.
+func handleOutput(w http.ResponseWriter, r *http.Request) error {
+	id := r.FormValue("id")
+	if id == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("no id parameter"))
+	}
+	t, ok := lookupTask(id)
+	if !ok {
+		return httpError(http.StatusNotFound, fmt.Errorf("task not found"))
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return httpError(http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	off := 0
+	for {
+		b, next, changed := t.output.readFrom(off)
+		off = next
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		if changed == nil {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-changed:
+		}
+	}
+}
+
+// handleTrigger returns a handler which asks the main loop to run the job.
+func handleTrigger(runCh chan<- runRequest, job string) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httpError(http.StatusMethodNotAllowed, fmt.Errorf("method must be POST"))
+		}
+		req := runRequest{job: job}
+		if job == "backup" {
+			if err := r.ParseForm(); err != nil {
+				return httpError(http.StatusBadRequest, err)
+			}
+			req.hosts = r.Form["host"]
+			if len(req.hosts) == 0 {
+				return httpError(http.StatusBadRequest, fmt.Errorf("no host parameter"))
+			}
+			for _, host := range req.hosts {
+				if _, ok := backupSource(host); !ok {
+					return httpError(http.StatusNotFound, fmt.Errorf("host %q is neither in -backup_hosts nor in -opportunistic_backup_hosts", host))
+				}
+			}
+		}
+		select {
+		case runCh <- req:
+		default:
+			return httpError(http.StatusConflict, fmt.Errorf("a job is already running"))
+		}
+		log.Printf("%s: started %v", r.URL.Path, req)
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "started %v\n", req)
+		return nil
+	}
+}
+
+func handleCancel(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return httpError(http.StatusMethodNotAllowed, fmt.Errorf("method must be POST"))
+	}
+	reason := "canceled via HTTP API"
+	if s := r.FormValue("reason"); s != "" {
+		reason += ": " + s
+	}
+	if !cancelRun(errors.New(reason)) {
+		return httpError(http.StatusConflict, fmt.Errorf("no job is running"))
+	}
+	log.Printf("%s: %s", r.URL.Path, reason)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+	fmt.Fprintf(w, "%s\n", reason)
+	return nil
+}
+
+func registerHandlers(runCh chan<- runRequest) {
+	http.Handle("/", handleError(handleStatusPage))
+	http.Handle("/status", handleError(handleStatus))
+	http.Handle("/output", handleError(handleOutput))
+	http.Handle("/run", handleError(handleTrigger(runCh, "run")))
+	http.Handle("/backup", handleError(handleTrigger(runCh, "backup")))
+	http.Handle("/sync", handleError(handleTrigger(runCh, "sync")))
+	http.Handle("/retry", handleError(handleTrigger(runCh, "retry")))
+	http.Handle("/cancel", handleError(handleCancel))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with the usual five fields (minute,
+// hour, day of month, month, day of week). Each field is *, a number, a range
+// (1-5), a list (1,3,5) or a step (*/15, 0-30/10). Months and days of week
+// can also be specified by their English three-letter abbreviation.
+type cronSchedule struct {
+	expr   string
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool // 1-31
+	month  [13]bool // 1-12
+	dow    [7]bool  // 0 (Sunday) - 6
+
+	// Like in Vixie cron, if both day of month and day of week are
+	// restricted, a day matches when either field matches. Fields starting
+	// with * (e.g. */2) count as unrestricted.
+	domStar, dowStar bool
+}
+
+var (
+	monthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dowNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCronValue(s string, names []string) (int, error) {
+	for idx, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return idx, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// parseCronField sets set[i] for all values i matched by field, which must lie
+// within [min, max].
+func parseCronField(field string, set []bool, min, max int, names []string) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = parseCronValue(loStr, names)
+			if err != nil {
+				return fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				hi, err = parseCronValue(hiStr, names)
+				if err != nil {
+					return fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max // e.g. 5/15 means 5-59/15
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q out of range [%d, %d]", part, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+	return nil
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", expr, len(fields))
+	}
+	s := &cronSchedule{
+		expr:    expr,
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	// Day of week 7 is Sunday, too.
+	var dow [8]bool
+	for _, f := range []struct {
+		field    string
+		set      []bool
+		min, max int
+		names    []string
+	}{
+		{fields[0], s.minute[:], 0, 59, nil},
+		{fields[1], s.hour[:], 0, 23, nil},
+		{fields[2], s.dom[:], 1, 31, nil},
+		{fields[3], s.month[:], 1, 12, monthNames},
+		{fields[4], dow[:], 0, 7, dowNames},
+	} {
+		if err := parseCronField(f.field, f.set, f.min, f.max, f.names); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+	}
+	copy(s.dow[:], dow[:7])
+	if dow[7] {
+		s.dow[0] = true
+	}
+	return s, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[t.Weekday()]
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t matching the schedule, or the zero
+// time if there is none within the next 5 years (e.g. for February 30th).
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		y, m, d := t.Date()
+		if !s.month[m] {
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !s.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) String() string { return s.expr }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // for Europe/Zurich
+)
+
+func TestParseCron(t *testing.T) {
+	// match and nomatch list times (as "2006-01-02 15:04" in UTC) which the
+	// expression must or must not match.
+	for _, tt := range []struct {
+		expr    string
+		match   []string
+		nomatch []string
+	}{
+		{"0 10 * * *", []string{"2026-10-16 10:00"}, []string{"2026-10-16 10:01", "2026-10-16 11:00"}},
+		{"*/15 * * * *", []string{"2026-10-16 10:00", "2026-10-16 10:45"}, []string{"2026-10-16 10:10"}},
+		{"5-30/10 * * * *", []string{"2026-10-16 10:05", "2026-10-16 10:25"}, []string{"2026-10-16 10:35", "2026-10-16 10:00"}},
+		{"5/20 * * * *", []string{"2026-10-16 10:05", "2026-10-16 10:45"}, []string{"2026-10-16 10:00"}},
+		{"0 1,13 * * *", []string{"2026-10-16 01:00", "2026-10-16 13:00"}, []string{"2026-10-16 02:00"}},
+		// 2026-10-16 is a Friday.
+		{"0 10 * * mon-fri", []string{"2026-10-16 10:00"}, []string{"2026-10-17 10:00"}},
+		{"0 10 * * MON-Fri", []string{"2026-10-16 10:00"}, []string{"2026-10-18 10:00"}},
+		{"0 10 * oct *", []string{"2026-10-16 10:00"}, []string{"2026-11-16 10:00"}},
+		// Day of week 7 is Sunday, like 0.
+		{"0 10 * * 7", []string{"2026-10-18 10:00"}, []string{"2026-10-17 10:00"}},
+		{"0 10 * * 5-7", []string{"2026-10-16 10:00", "2026-10-18 10:00"}, []string{"2026-10-19 10:00"}},
+		// Both day fields restricted: either matches.
+		{"0 10 1 * mon", []string{"2026-10-01 10:00", "2026-10-19 10:00"}, []string{"2026-10-16 10:00"}},
+		// Day of month starting with *: both must match (like Vixie cron).
+		{"0 3 */2 * mon", []string{"2026-10-05 03:00"}, []string{"2026-10-12 03:00", "2026-10-07 03:00"}},
+	} {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []struct {
+				times []string
+				match bool
+			}{{tt.match, true}, {tt.nomatch, false}} {
+				for _, ts := range want.times {
+					tm, err := time.Parse("2006-01-02 15:04", ts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := s.next(tm.Add(-time.Minute)).Equal(tm); got != want.match {
+						t.Errorf("%q matches %s = %v, want %v", tt.expr, ts, got, want.match)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * * sunday",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"30-10 * * * *",
+		"a * * * *",
+		"1- * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) unexpectedly succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		desc string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{
+			desc: "same day",
+			expr: "0 10 * * *",
+			from: time.Date(2026, 10, 16, 9, 30, 12, 0, time.UTC),
+			want: time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "strictly after",
+			expr: "0 10 * * *",
+			from: time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC),
+			want: time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "month rollover",
+			expr: "0 10 31 * *",
+			from: time.Date(2026, 10, 31, 11, 0, 0, 0, time.UTC),
+			want: time.Date(2026, 12, 31, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "year rollover",
+			expr: "0 0 1 jan *",
+			from: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "leap day",
+			expr: "0 0 29 feb *",
+			from: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "february 30th never matches",
+			expr: "0 0 30 feb *",
+			from: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want: time.Time{},
+		},
+		{
+			// 02:30 does not exist on 2026-03-29 in Europe/Zurich (clocks
+			// jump from 02:00 to 03:00), so the run on that day is skipped.
+			desc: "DST gap",
+			expr: "30 2 * * *",
+			from: time.Date(2026, 3, 29, 0, 0, 0, 0, zurich),
+			want: time.Date(2026, 3, 30, 2, 30, 0, 0, zurich),
+		},
+		{
+			desc: "after DST gap",
+			expr: "30 3 * * *",
+			from: time.Date(2026, 3, 29, 0, 0, 0, 0, zurich),
+			want: time.Date(2026, 3, 29, 3, 30, 0, 0, zurich),
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("%q.next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,15 +3,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
-	"net/http"
+	"math/rand/v2"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
 	"github.com/stapelberg/zkj-nas-tools/internal/wake"
 	"golang.org/x/sync/errgroup"
 )
@@ -39,6 +42,16 @@ var (
 		"/perm/id_ed25519_drsync",
 		"Path to the SSH private key file to authenticate with at -storage_hosts for syncing")
 
+	runTimeout = flag.Duration("run_timeout",
+		20*time.Hour,
+		"Maximum duration of a run (backup and/or sync) before it is canceled")
+	hostTimeout = flag.Duration("host_timeout",
+		6*time.Hour,
+		"Maximum duration of backing up (or syncing) a single host before it is canceled")
+	dramaqueenLeaseTTL = flag.Duration("dramaqueen_lease_ttl",
+		30*time.Minute,
+		"TTL of the dramaqueen locks held while backing up and syncing. Locks are renewed while held, so that a NAS can still shut down on its own if dornröschen crashes.")
+
 	mqttBroker = flag.String("mqtt_broker",
 		"tcp://mqtt.lan:1883",
 		"MQTT broker address for github.com/eclipse/paho.mqtt.golang")
@@ -52,23 +65,23 @@ func splitHostMAC(hostmac string) (host, mac string) {
 	return parts[0], parts[1]
 }
 
-func wakeUp(host, mac string) (woken bool, _ error) {
-	target := wake.Host{
-		Name: host,
-		IP:   host,
-		MAC:  mac,
-	}
-	// Pick up extra fields (notably SmartPlug) from the canonical host
-	// table when we recognize the IP.
-	for _, h := range wake.Hosts {
-		if h.IP == host {
-			target.Name = h.Name
-			target.SmartPlug = h.SmartPlug
-			break
-		}
+// wakeConfig returns the wake.Config for host. Hosts from the inventory (looked
+// up by IP) keep their configuration (notably Power, WOL and Readiness), only
+// the MAC address from the flags takes precedence.
+func wakeConfig(host, mac string) wake.Config {
+	target, ok := wake.LookupHostByIP(host)
+	if !ok {
+		target = wake.Host{Name: host, IP: host}
+	}
+	if mac != "" {
+		target.MAC = mac
 	}
-	cfg := wake.Config{Target: target}
-	err := cfg.Wakeup(context.Background())
+	return wake.Config{Target: target}
+}
+
+func wakeUp(ctx context.Context, host, mac string) (woken bool, _ error) {
+	cfg := wakeConfig(host, mac)
+	err := cfg.Wakeup(ctx)
 	if err == wake.ErrAlreadyRunning {
 		return false, nil // already up and running
 	}
@@ -78,56 +91,141 @@ func wakeUp(host, mac string) (woken bool, _ error) {
 	return true, nil // successfully woken up
 }
 
-func dramaqueenRequest(NAS, lock, method string) error {
-	retry := 0
-	for retry < 5 {
-		retry++
-		resp, err := http.Post("http://"+NAS+":4414/"+method+"?key="+lock, "text/plain", nil)
-		if err != nil {
-			if retry == 5 {
-				return fmt.Errorf(`Could not acquire dramaqueen lock on %s: %v`, NAS, err)
-			} else {
-				log.Printf(`Could not acquire dramaqueen lock on %s: %v`, NAS, err)
-				time.Sleep(time.Duration(math.Pow(2, float64(retry))) * time.Second)
-				continue
-			}
+// dramaqueenInstance identifies this dornröschen process. It is random
+// because the clock might not be set yet and PIDs repeat after reboots.
+var dramaqueenInstance = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("dornröschen@%s/%08x", hostname, rand.Uint32())
+}()
+
+// dramaqueenLocks counts the dramaqueen locks acquired by this process.
+var dramaqueenLocks atomic.Int64
+
+// dramaqueenOwner returns a new owner for a dramaqueen lock. Each run uses its
+// own owner, so that overlapping runs within this process (e.g. an
+// opportunistic and a scheduled backup of the same host) conflict just like
+// runs of different dornröschen instances, instead of renewing and releasing
+// each other’s locks.
+func dramaqueenOwner() string {
+	return fmt.Sprintf("%s.%d", dramaqueenInstance, dramaqueenLocks.Add(1))
+}
+
+// lockDramaqueen prevents dramaqueen on NAS from shutting it down until the
+// returned lease is released. Network errors are retried. If another owner
+// holds the lock (e.g. an overrunning dornröschen elsewhere), a
+// *dramaqueen.ConflictError is returned right away.
+func lockDramaqueen(ctx context.Context, NAS, lock, reason string) (*dramaqueen.Lease, error) {
+	client := &dramaqueen.Client{Host: NAS, Owner: dramaqueenOwner()}
+	for retry := 1; ; retry++ {
+		lease, err := client.Acquire(ctx, lock, reason, *dramaqueenLeaseTTL)
+		if err == nil {
+			log.Printf("dramaqueen lock %s acquired on %s", lock, NAS)
+			return lease, nil
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			return fmt.Errorf(`dramaqueen request on %s resulted in HTTP %d`, NAS, resp.StatusCode)
+		var conflict *dramaqueen.ConflictError
+		if errors.As(err, &conflict) || retry == 5 || ctx.Err() != nil {
+			return nil, fmt.Errorf("Could not acquire dramaqueen lock %s on %s: %w", lock, NAS, err)
+		}
+		log.Printf("Could not acquire dramaqueen lock %s on %s: %v", lock, NAS, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(math.Pow(2, float64(retry))) * time.Second):
 		}
-		log.Printf("dramaqueen lock request succeeded: lock=%s method=%s", lock, method)
-		break
 	}
-	return nil
 }
 
-func lockDramaqueen(NAS, lock string) error {
-	// TODO: dramaqueen should return an error if the lock already exists so that overruns will fail.
-	return dramaqueenRequest(NAS, lock, "inhibit")
+func backupLockName(sourceHost string) string {
+	return "backup-" + sourceHost
+}
+
+func releaseDramaqueenLock(NAS, lock string, lease *dramaqueen.Lease) {
+	if err := lease.Release(); err != nil {
+		log.Printf("Could not release dramaqueen lock %s on %s: %v", lock, NAS, err)
+	}
 }
 
-func releaseDramaqueenLock(NAS, lock string) error {
-	return dramaqueenRequest(NAS, lock, "release")
+// withCause annotates err with the reason why ctx was canceled, if it was.
+func withCause(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%v (canceled: %v)", err, context.Cause(ctx))
 }
 
-func backup1(destHost, sourceHost, sourceMAC string) error {
+// backupState is kept across the attempts of backing up a host.
+type backupState struct {
+	// woken is set when sourceHost was woken up (in this or an earlier
+	// attempt) and hence should be suspended afterwards.
+	woken bool
+	// lease is the dramaqueen lock on the destination NAS. It is held until
+	// the last attempt finished, so that the NAS does not shut down while
+	// waiting to retry.
+	lease *dramaqueen.Lease
+}
+
+// backup1 makes one attempt at backing up sourceHost. Errors are of type
+// *backupError.
+func backup1(runCtx context.Context, t *task, attempt int, st *backupState, destHost, sourceHost, sourceMAC string) (err error) {
 	log := log.New(os.Stderr, sourceHost+" ", log.LstdFlags)
+	ctx, canc := context.WithTimeoutCause(runCtx, *hostTimeout,
+		fmt.Errorf("backup of %s exceeded -host_timeout=%v", sourceHost, *hostTimeout))
+	defer canc()
+
+	entry := journalEntry{
+		Kind:        "backup",
+		Source:      sourceHost,
+		Destination: destHost,
+		Start:       time.Now(),
+		ExitCode:    -1,
+		Attempt:     attempt,
+	}
+	class := failureRsync
+	defer func() {
+		if err != nil {
+			if runCtx.Err() != nil {
+				class = failureCanceled
+			} else if ctx.Err() != nil {
+				class = failureTimeout
+			}
+			err = &backupError{class: class, err: withCause(ctx, err)}
+		}
+		entry.End = time.Now()
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		recordRun(entry)
+	}()
 
 	// Prevent dramaqueen on the destination NAS from shutting it down. If
 	// the dramaqueen lock cannot be acquired, just continue and hope for
 	// the best (in case a NAS is not running dramaqueen, it won’t shut
-	// down automatically anyway).
-	lockname := "backup-" + sourceHost
-	if err := lockDramaqueen(destHost, lockname); err == nil {
-		defer releaseDramaqueenLock(destHost, lockname)
+	// down automatically anyway), unless somebody else holds the lock.
+	if st.lease == nil {
+		t.setPhase("locking dramaqueen")
+		lease, lockErr := lockDramaqueen(ctx, destHost, backupLockName(sourceHost), "backup of "+sourceHost)
+		if lockErr != nil {
+			if errors.As(lockErr, new(*dramaqueen.ConflictError)) {
+				class = failureLock
+				return fmt.Errorf("backup of %s failed: %v", sourceHost, lockErr)
+			}
+			log.Print(lockErr)
+		} else {
+			st.lease = lease
+		}
 	}
 
-	woken := false
 	if sourceMAC != "" {
-		var err error
-		woken, err = wakeUp(sourceHost, sourceMAC)
+		t.setPhase("waking up")
+		w, err := wakeUp(ctx, sourceHost, sourceMAC)
+		if w {
+			st.woken = true
+		}
+		entry.Woken = w
 		if err != nil {
+			class = failureWake
 			return fmt.Errorf("backup of %s failed: %v", sourceHost, err)
 		}
 	}
@@ -135,7 +233,12 @@ func backup1(destHost, sourceHost, sourceMAC string) error {
 	// The command is just destHost, because for the SSH key this program
 	// is using, the remote host will only ever run /root/backup.pl, which
 	// interprets the command as the destination host.
-	outputfile, err := rsyncSSH(sourceHost, destHost, *backupPrivateKeyPath, destHost)
+	t.setPhase("rsync")
+	outputfile, res, err := rsyncSSH(ctx, "backup", sourceHost, destHost, *backupPrivateKeyPath, destHost, t.output)
+	entry.ExitCode = res.ExitCode
+	if res.Stats != nil {
+		entry.BytesTransferred = res.Stats.TotalWritten
+	}
 	// Dump the output into the log, which is persisted via remote syslog:
 	if b, err := os.ReadFile(outputfile); err == nil {
 		log.Println("SSH output")
@@ -145,38 +248,71 @@ func backup1(destHost, sourceHost, sourceMAC string) error {
 		log.Println("End of SSH output")
 	}
 	if err != nil {
-		return fmt.Errorf("backup of %s failed: %v\n", sourceHost, err)
+		if !res.Started {
+			class = failureSSH
+		}
+		return fmt.Errorf("backup of %s failed: %v", sourceHost, err)
 	}
 
 	// Suspend the machine to RAM, but only if we have woken it up.
 	// midna suspends if pacna is running.
-	suspend := woken || sourceHost == "midna"
+	suspend := st.woken || sourceHost == "midna"
 	if !suspend {
 		return nil
 	}
 
+	t.setPhase("suspending")
 	suspendNAS(sourceHost)
+	entry.Suspended = true
 	return nil
 }
 
-func backup(dest string, sources []string) (woken bool, _ error) {
+func backup(ctx context.Context, dest string, sources []string) (woken bool, _ error) {
 	log.Printf("Backup destination is %s", dest)
 	destHost, destMAC := splitHostMAC(dest)
+	recordDestination(destHost)
 
-	wokenNAS, err := wakeUp(destHost, destMAC)
+	tasks := make([]*task, len(sources))
+	for idx, source := range sources {
+		sourceHost, _ := splitHostMAC(source)
+		tasks[idx] = beginTask("backup", sourceHost, destHost, "waking up NAS")
+	}
+
+	start := time.Now()
+	wokenNAS, err := wakeUp(ctx, destHost, destMAC)
 	if err != nil {
-		return false, fmt.Errorf("Could not wake up NAS %s: %v", destHost, err)
+		err = withCause(ctx, fmt.Errorf("Could not wake up NAS %s: %v", destHost, err))
+		for idx, source := range sources {
+			sourceHost, _ := splitHostMAC(source)
+			tasks[idx].finish(ctx, err)
+			recordRun(journalEntry{
+				Kind:        "backup",
+				Source:      sourceHost,
+				Destination: destHost,
+				Start:       start,
+				End:         time.Now(),
+				ExitCode:    -1,
+				Error:       err.Error(),
+			})
+		}
+		return false, err
 	}
 
 	// Just in case dramaqueen needs some extra time to start up.
-	time.Sleep(60 * time.Second)
+	for _, t := range tasks {
+		t.setPhase("waiting for dramaqueen")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(60 * time.Second):
+	}
 
 	// Run all backups in parallel
 	var eg errgroup.Group
-	for _, source := range sources {
+	for idx, source := range sources {
 		sourceHost, sourceMAC := splitHostMAC(source)
 		eg.Go(func() error {
-			if err := backup1(destHost, sourceHost, sourceMAC); err != nil {
+			if err := backupWithRetries(ctx, tasks[idx], destHost, sourceHost, sourceMAC); err != nil {
 				log.Print(err)
 			}
 			return nil
@@ -190,36 +326,102 @@ func backup(dest string, sources []string) (woken bool, _ error) {
 	return wokenNAS, nil
 }
 
+// suspendNAS suspends destHost to RAM. It is not canceled along with the run
+// so that canceled runs do not leave machines running.
 func suspendNAS(destHost string) {
 	log.Printf("suspending NAS %s", destHost)
-	if err := sshCommand(log.Default(), destHost, *suspendPrivateKeyPath, ""); err != nil {
+	ctx, canc := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer canc()
+	if err := sshCommand(ctx, log.Default(), destHost, *suspendPrivateKeyPath, ""); err != nil {
 		log.Printf("Suspending %s failed: %v", destHost, err)
 	}
+	// Connections to a suspended host are dead.
+	sshClients.closeHost(destHost)
 }
 
-func sync(NASen []string) error {
+func sync(ctx context.Context, NASen []string) error {
+	pairs, err := syncPairs(NASen)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]*task, len(pairs))
+	for idx, pair := range pairs {
+		sourceHost, _ := splitHostMAC(pair.source)
+		destHost, _ := splitHostMAC(pair.dest)
+		tasks[idx] = beginTask("sync", sourceHost, destHost, "waking up NASen")
+	}
+
 	for _, dest := range NASen {
 		destHost, destMAC := splitHostMAC(dest)
-		woken, err := wakeUp(destHost, destMAC)
+		woken, err := wakeUp(ctx, destHost, destMAC)
 		if err != nil {
-			return fmt.Errorf("Could not wake up NAS %s\n", destHost)
+			err = withCause(ctx, fmt.Errorf("Could not wake up NAS %s: %v", destHost, err))
+			for _, t := range tasks {
+				t.finish(ctx, err)
+			}
+			return err
 		}
 		if woken {
 			defer suspendNAS(destHost)
 		}
-		lockDramaqueen(destHost, "sync")
+		// Once the lock is released, the NASen will turn off on their own
+		// (unless somebody is using them, of course).
+		lease, err := lockDramaqueen(ctx, destHost, "sync", "sync of "+strings.Join(NASen, ", "))
+		if err != nil {
+			if errors.As(err, new(*dramaqueen.ConflictError)) {
+				for _, t := range tasks {
+					t.finish(ctx, err)
+				}
+				return err
+			}
+			log.Print(err)
+			continue
+		}
+		defer releaseDramaqueenLock(destHost, "sync", lease)
 	}
 
-	for idx, source := range NASen {
-		dest := NASen[(idx+1)%len(NASen)]
-		sourceHost, _ := splitHostMAC(source)
-		destHost, _ := splitHostMAC(dest)
+	for _, t := range tasks {
+		t.setPhase("waiting")
+	}
+
+	for idx, pair := range pairs {
+		t := tasks[idx]
+		sourceHost, _ := splitHostMAC(pair.source)
+		destHost, _ := splitHostMAC(pair.dest)
 		log.Printf("Syncing %s to %s", sourceHost, destHost)
 
-		outputfile, err := rsyncSSH(sourceHost, destHost, *syncPrivateKeyPath, destHost)
+		entry := journalEntry{
+			Kind:        "sync",
+			Source:      sourceHost,
+			Destination: destHost,
+			Start:       time.Now(),
+		}
+		if err := context.Cause(ctx); err != nil {
+			err = fmt.Errorf("not started (canceled: %v)", err)
+			entry.End = entry.Start
+			entry.Error = err.Error()
+			recordRun(entry)
+			t.finish(ctx, err)
+			continue
+		}
+		t.setPhase("rsync")
+		pairCtx, canc := context.WithTimeoutCause(ctx, *hostTimeout,
+			fmt.Errorf("sync of %s to %s exceeded -host_timeout=%v", sourceHost, destHost, *hostTimeout))
+		outputfile, res, err := rsyncSSH(pairCtx, "sync", sourceHost, destHost, *syncPrivateKeyPath, destHost, t.output)
+		err = withCause(pairCtx, err)
+		canc()
+		entry.End = time.Now()
+		entry.ExitCode = res.ExitCode
+		if res.Stats != nil {
+			entry.BytesTransferred = res.Stats.TotalWritten
+		}
 		if err != nil {
 			log.Printf("Syncing of %s to %s failed: %v", sourceHost, destHost, err)
+			entry.Error = err.Error()
 		}
+		recordRun(entry)
+		t.finish(pairCtx, err)
 		log.Printf("sync %s to %s output stored in %s", sourceHost, destHost, outputfile)
 
 		// Dump the output into the log, which is persisted via remote syslog:
@@ -232,34 +434,25 @@ func sync(NASen []string) error {
 		}
 	}
 
-	for _, dest := range NASen {
-		destHost, _ := splitHostMAC(dest)
-		// With the lock released, the NASen will turn off on their own (unless
-		// somebody is using them, of course).
-		releaseDramaqueenLock(destHost, "sync")
-	}
-
 	return nil
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	if !*runBackup && !*runSync {
 		return fmt.Errorf("Neither -backup nor -sync enabled, nothing to do.")
 	}
 
 	storageList := strings.Split(*storageHosts, ",")
-	if len(storageList) > 2 {
-		return fmt.Errorf("More than 2 -storage_hosts are not supported. Please send a patch to fix.")
+	dest, err := pickDestination(ctx, storageList)
+	if err != nil {
+		return err
 	}
 
-	// Alternate between the available NASen to make sure each one works.
-	dest := storageList[(time.Now().Day()+1)%len(storageList)]
-
 	var firstErr error
 	wokenNAS := false
 	if *runBackup {
 		var err error
-		wokenNAS, err = backup(dest, strings.Split(*backupHosts, ","))
+		wokenNAS, err = backup(ctx, dest, strings.Split(*backupHosts, ","))
 		if err != nil {
 			log.Printf("backup: %v", err)
 			if firstErr == nil {
@@ -270,7 +463,7 @@ func run() error {
 	}
 
 	if *runSync {
-		if err := sync(storageList); err != nil {
+		if err := sync(ctx, storageList); err != nil {
 			log.Printf("sync: %v", err)
 			if firstErr == nil {
 				firstErr = err
@@ -278,25 +471,67 @@ func run() error {
 		}
 	}
 
-	if wokenNAS {
-		destHost, _ := splitHostMAC(dest)
-		suspendNAS(destHost)
-	}
+	destHost, _ := splitHostMAC(dest)
+	releaseNAS(destHost, wokenNAS)
 
 	return firstErr
 }
 
+// backupTo backs up the specified -backup_hosts entries to the destination
+// picked by -destination_policy, suspending the NAS afterwards if it was woken
+// up for the backup (see releaseNAS).
+func backupTo(ctx context.Context, sources []string) error {
+	storageList := strings.Split(*storageHosts, ",")
+	dest, err := pickDestination(ctx, storageList)
+	if err != nil {
+		return err
+	}
+
+	wokenNAS, err := backup(ctx, dest, sources)
+	destHost, _ := splitHostMAC(dest)
+	releaseNAS(destHost, wokenNAS)
+	if err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	return nil
+}
+
+// backupHostList backs up hosts, which must be listed in -backup_hosts or
+// -opportunistic_backup_hosts. If hosts is empty, all -backup_hosts are
+// backed up.
+func backupHostList(ctx context.Context, hosts []string) error {
+	if len(hosts) == 0 {
+		return backupTo(ctx, strings.Split(*backupHosts, ","))
+	}
+	var sources []string
+	for _, host := range hosts {
+		source, ok := backupSource(host)
+		if !ok {
+			return fmt.Errorf("host %q is neither in -backup_hosts nor in -opportunistic_backup_hosts", host)
+		}
+		sources = append(sources, source)
+	}
+	return backupTo(ctx, sources)
+}
+
 func reachableViaSSH(host string) bool {
 	ctx, canc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer canc()
-	return wake.PollSSH1(ctx, host+":22") == nil
+	_, addr := sshTarget(host)
+	return wake.PollSSH1(ctx, addr) == nil
 }
 
-func runOpportunisticBackups1(host string) {
+func runOpportunisticBackups1(ctx context.Context, host string) {
 	var startBackup time.Time
 	prevReachable := false
-	tick := time.Tick(5 * time.Minute)
-	for range tick {
+	tick := time.NewTicker(5 * time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
 		nowReachable := reachableViaSSH(host)
 		log.Printf("[%s] opportunistic backup check; reachable=%v", host, nowReachable)
 		if !prevReachable && nowReachable {
@@ -308,32 +543,22 @@ func runOpportunisticBackups1(host string) {
 		} else if prevReachable && nowReachable && time.Now().After(startBackup) && !startBackup.IsZero() {
 			startBackup = time.Time{}
 
-			storageList := strings.Split(*storageHosts, ",")
-			if len(storageList) > 2 {
-				log.Printf("More than 2 -storage_hosts are not supported. Please send a patch to fix.")
-				continue
-			}
-
-			// Alternate between the available NASen to make sure each one works.
-			dest := storageList[(time.Now().Day()+1)%len(storageList)]
-
-			log.Printf("[%s] starting backup to dest=%s", host, dest)
-
-			wokenNAS, err := backup(dest, []string{host + "/"})
-			if err != nil {
-				log.Printf("backup: %v", err)
-			}
-
-			if wokenNAS {
-				destHost, _ := splitHostMAC(dest)
-				suspendNAS(destHost)
+			log.Printf("[%s] starting opportunistic backup", host)
+			runCtx, canc := context.WithTimeoutCause(ctx, *runTimeout,
+				fmt.Errorf("opportunistic backup of %s exceeded -run_timeout=%v", host, *runTimeout))
+			if err := backupTo(runCtx, []string{host + "/"}); err != nil {
+				log.Printf("[%s] %v", host, err)
 			}
+			canc()
 		}
 		prevReachable = nowReachable
 	}
 }
 
-func runOpportunisticBackups(hostsList string) {
+// runOpportunisticBackups keeps track of hostsList until ctx is canceled.
+// done is called once all backups have finished.
+func runOpportunisticBackups(ctx context.Context, hostsList string, done func()) {
+	var eg errgroup.Group
 	hosts := strings.Split(hostsList, ",")
 	for _, hostsPart := range hosts {
 		h := strings.TrimSpace(hostsPart)
@@ -341,6 +566,11 @@ func runOpportunisticBackups(hostsList string) {
 			continue
 		}
 		log.Printf("keeping track of host %s for opportunistic backup", h)
-		go runOpportunisticBackups1(h)
+		eg.Go(func() error {
+			runOpportunisticBackups1(ctx, h)
+			return nil
+		})
 	}
+	eg.Wait()
+	done()
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	gosync "sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stapelberg/zkj-nas-tools/internal/wake"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	knownHostsPath = flag.String("ssh_known_hosts_path",
+		"/perm/dr-known_hosts",
+		"Path to an OpenSSH known_hosts file against which SSH host keys are verified. Keys of hosts which are not listed yet are added on first use.")
+	sshOverrides = flag.String("ssh_overrides",
+		"",
+		"Comma-separated list of [user@]host[:port] entries, overriding the SSH user (default root) and port (default 22) for host")
+)
+
+var hostKeyMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ssh_host_key_mismatches_total",
+	Help: "SSH connections refused because the host key did not match -ssh_known_hosts_path",
+}, []string{"host"})
+
+func init() {
+	prometheus.MustRegister(hostKeyMismatches)
+}
+
+// sshOverride is an entry of -ssh_overrides. Empty fields are not overridden.
+type sshOverride struct {
+	user, port string
+}
+
+// sshOverridesByHost is set by parseSSHOverrides at startup.
+var sshOverridesByHost map[string]sshOverride
+
+// parseSSHOverrides parses -ssh_overrides, keyed by host. Later entries for
+// the same host take precedence.
+func parseSSHOverrides(s string) (map[string]sshOverride, error) {
+	result := make(map[string]sshOverride)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, hostport, hasUser := strings.Cut(entry, "@")
+		if !hasUser {
+			u, hostport = "", entry
+		}
+		h, p := hostport, ""
+		if strings.Contains(hostport, ":") {
+			var err error
+			h, p, err = net.SplitHostPort(hostport)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not in format [user@]host[:port]: %v", entry, err)
+			}
+			if port, err := strconv.Atoi(p); err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("%q: invalid port %q", entry, p)
+			}
+		}
+		if h == "" || (hasUser && u == "") {
+			return nil, fmt.Errorf("%q is not in format [user@]host[:port]", entry)
+		}
+		o := result[h]
+		if u != "" {
+			o.user = u
+		}
+		if p != "" {
+			o.port = p
+		}
+		result[h] = o
+	}
+	return result, nil
+}
+
+// sshTarget returns the user to log in as and the address to connect to for
+// host, taking -ssh_overrides into account.
+func sshTarget(host string) (user, addr string) {
+	user, port := "root", "22"
+	if o, ok := sshOverridesByHost[host]; ok {
+		if o.user != "" {
+			user = o.user
+		}
+		if o.port != "" {
+			port = o.port
+		}
+	}
+	return user, net.JoinHostPort(host, port)
+}
+
+// probeSSHAddr returns the address to connect to for ssh and mount readiness
+// probes of host, taking -ssh_overrides into account (see wake.SSHAddr).
+func probeSSHAddr(host wake.Host) string {
+	_, addr := sshTarget(host.IP)
+	return addr
+}
+
+// knownHostsMu serializes reading and appending to -ssh_known_hosts_path.
+var knownHostsMu gosync.Mutex
+
+func loadKnownHosts() (ssh.HostKeyCallback, error) {
+	// knownhosts.New fails if the file does not exist.
+	f, err := os.OpenFile(*knownHostsPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return knownhosts.New(*knownHostsPath)
+}
+
+// verifyHostKey is an ssh.HostKeyCallback which checks key against
+// -ssh_known_hosts_path, adding it if the host is not listed yet (trust on
+// first use).
+func verifyHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	check, err := loadKnownHosts()
+	if err != nil {
+		return err
+	}
+	err = check(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err // nil if the key is known
+	}
+	if len(keyErr.Want) > 0 {
+		hostKeyMismatches.WithLabelValues(knownhosts.Normalize(hostname)).Inc()
+		want := keyErr.Want[0]
+		return fmt.Errorf("SSH host key of %s has CHANGED: got %s %s, but %s:%d has %s %s. Somebody could be impersonating the host, refusing to connect. If the host key was changed legitimately, remove the line from %s",
+			hostname,
+			key.Type(), ssh.FingerprintSHA256(key),
+			want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key),
+			want.Filename)
+	}
+
+	f, err := os.OpenFile(*knownHostsPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := f.Write([]byte(line + "\n")); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("%s: trusting SSH host key %s %s on first use", hostname, key.Type(), ssh.FingerprintSHA256(key))
+	return nil
+}
+
+// placeholderKey is never a known host key, so checking it yields all known
+// keys of a host.
+var placeholderKey = func() ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// hostKeyAlgorithms returns the algorithms of the known host keys of addr, so
+// that the server presents a key we know (instead of e.g. its RSA key when we
+// pinned its Ed25519 key). It returns nil for hosts without known keys.
+func hostKeyAlgorithms(addr string) []string {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	check, err := loadKnownHosts()
+	if err != nil {
+		return nil
+	}
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	err = check(addr, &net.TCPAddr{IP: net.IPv4zero, Port: port}, placeholderKey)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, want := range keyErr.Want {
+		if want.Key.Type() == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+			continue
+		}
+		algos = append(algos, want.Key.Type())
+	}
+	return algos
+}
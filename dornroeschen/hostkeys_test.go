@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stapelberg/zkj-nas-tools/internal/wake"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHOverrides(t *testing.T) {
+	got, err := parseSSHOverrides("backup@midna, 10.0.0.253:2222,storage2:2200, admin@storage2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]sshOverride{
+		"midna":      {user: "backup"},
+		"10.0.0.253": {port: "2222"},
+		"storage2":   {user: "admin", port: "2200"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSSHOverrides() = %+v, want %+v", got, want)
+	}
+
+	for _, invalid := range []string{
+		"midna:",
+		"midna:ssh",
+		"midna:70000",
+		"@midna",
+		"backup@",
+		"[::1:22",
+	} {
+		if _, err := parseSSHOverrides(invalid); err == nil {
+			t.Errorf("parseSSHOverrides(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// hostKeyMismatchesOf returns the ssh_host_key_mismatches_total value of host.
+func hostKeyMismatchesOf(t *testing.T, host string) float64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "ssh_host_key_mismatches_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "host" && l.GetValue() == host {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	defer func(old string) { *knownHostsPath = old }(*knownHostsPath)
+	*knownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+
+	const host = "midna"
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.252"), Port: 22}
+	key, changed := newHostKey(t), newHostKey(t)
+	before := hostKeyMismatchesOf(t, host)
+
+	// The cases run in order, sharing -ssh_known_hosts_path.
+	for _, tt := range []struct {
+		desc           string
+		key            ssh.PublicKey
+		wantErr        bool
+		wantLines      int
+		wantMismatches float64
+	}{
+		{desc: "unknown host is trusted on first use", key: key, wantLines: 1},
+		{desc: "known key is accepted", key: key, wantLines: 1},
+		{desc: "changed key is refused", key: changed, wantErr: true, wantLines: 1, wantMismatches: 1},
+	} {
+		err := verifyHostKey(host+":22", remote, tt.key)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: verifyHostKey() = %v, want error = %v", tt.desc, err, tt.wantErr)
+		}
+		b, err := os.ReadFile(*knownHostsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != tt.wantLines {
+			t.Errorf("%s: %s contains %d lines, want %d:\n%s", tt.desc, *knownHostsPath, len(lines), tt.wantLines, b)
+		}
+		if want := host + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))); lines[0] != want {
+			t.Errorf("%s: %s: got %q, want %q", tt.desc, *knownHostsPath, lines[0], want)
+		}
+		if got := hostKeyMismatchesOf(t, host) - before; got != tt.wantMismatches {
+			t.Errorf("%s: ssh_host_key_mismatches_total increased by %v, want %v", tt.desc, got, tt.wantMismatches)
+		}
+	}
+}
+
+func TestProbeSSHAddr(t *testing.T) {
+	defer func(old map[string]sshOverride) { sshOverridesByHost = old }(sshOverridesByHost)
+	var err error
+	sshOverridesByHost, err = parseSSHOverrides("backup@myvm:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host wake.Host
+		want string
+	}{
+		{wake.Host{Name: "myvm", IP: "myvm"}, "myvm:2222"},
+		{wake.Host{Name: "storage2", IP: "10.0.0.253"}, "10.0.0.253:22"},
+	} {
+		if got := probeSSHAddr(tt.host); got != tt.want {
+			t.Errorf("probeSSHAddr(%+v) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	gosync "sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var journalPath = flag.String("journal_path",
+	"/perm/dr-journal.jsonl",
+	"path to a file to which to append one JSON line per backup/sync of a host. Only the most recent entries of each host are kept.")
+
+// journalKeepPerHost is how many entries to keep per kind, source and
+// destination when compacting the journal.
+const journalKeepPerHost = 20
+
+// journalEntry records one backup (or sync) of a single source host.
+type journalEntry struct {
+	Kind        string    `json:"kind"` // backup or sync
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	ExitCode    int       `json:"exit_code"`
+	// Attempt is the number of the attempt (see -retry_policy_file), starting
+	// at 1.
+	Attempt int `json:"attempt,omitempty"`
+	// BytesTransferred is the number of bytes written by rsync, if found in
+	// its output.
+	BytesTransferred int64  `json:"bytes_transferred"`
+	Woken            bool   `json:"woken"`
+	Suspended        bool   `json:"suspended"`
+	Error            string `json:"error,omitempty"`
+}
+
+var hostLabels = []string{"kind", "source", "destination"}
+
+var (
+	hostLastAttempt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "host_last_attempt",
+		Help: "Timestamp of the last backup/sync attempt of a host",
+	}, hostLabels)
+	hostLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "host_last_success",
+		Help: "Timestamp of the last successful backup/sync of a host",
+	}, hostLabels)
+	hostLastExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "host_last_exit_code",
+		Help: "rsync exit code of the last backup/sync attempt of a host (0 = success, 24 = success, but some files vanished, 255 = SSH failed)",
+	}, hostLabels)
+	hostLastBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "host_last_bytes_transferred",
+		Help: "Bytes written by rsync in the last backup/sync attempt of a host",
+	}, hostLabels)
+	hostLastDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "host_last_duration_seconds",
+		Help: "Duration of the last backup/sync attempt of a host",
+	}, hostLabels)
+)
+
+func init() {
+	prometheus.MustRegister(hostLastAttempt)
+	prometheus.MustRegister(hostLastSuccess)
+	prometheus.MustRegister(hostLastExitCode)
+	prometheus.MustRegister(hostLastBytes)
+	prometheus.MustRegister(hostLastDuration)
+}
+
+func (e *journalEntry) updateMetrics() {
+	labels := prometheus.Labels{
+		"kind":        e.Kind,
+		"source":      e.Source,
+		"destination": e.Destination,
+	}
+	hostLastAttempt.With(labels).Set(float64(e.Start.Unix()))
+	if e.Error == "" {
+		hostLastSuccess.With(labels).Set(float64(e.End.Unix()))
+	}
+	hostLastExitCode.With(labels).Set(float64(e.ExitCode))
+	hostLastBytes.With(labels).Set(float64(e.BytesTransferred))
+	hostLastDuration.With(labels).Set(e.End.Sub(e.Start).Seconds())
+}
+
+var (
+	journalMu gosync.Mutex
+	// journalLines is the number of entries in the journal, journalKept the
+	// number of entries which were kept when it was last compacted.
+	journalLines, journalKept int
+)
+
+// recordRun appends e to the journal and updates the per-host metrics. Once
+// the journal doubled in size since it was last compacted, it is compacted.
+func recordRun(e journalEntry) {
+	e.updateMetrics()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("could not marshal journal entry: %v", err)
+		return
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	f, err := os.OpenFile(*journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("could not open journal: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("could not append to journal: %v", err)
+		return
+	}
+	journalLines++
+	if journalLines <= 2*max(journalKept, journalKeepPerHost) {
+		return
+	}
+	if _, err := compactJournal(); err != nil {
+		log.Printf("could not compact journal: %v", err)
+	}
+}
+
+// readJournal returns the entries of the journal, skipping invalid ones.
+func readJournal() ([]journalEntry, error) {
+	f, err := os.Open(*journalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("skipping invalid journal entry: %v", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// compactJournal rewrites the journal with only the last journalKeepPerHost
+// entries per kind, source and destination, and returns the kept entries.
+// journalMu must be held.
+func compactJournal() ([]journalEntry, error) {
+	entries, err := readJournal()
+	if err != nil {
+		return nil, err
+	}
+	type key struct{ kind, source, destination string }
+	newer := make(map[key]int)
+	keep := make([]bool, len(entries))
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		e := entries[idx]
+		k := key{e.Kind, e.Source, e.Destination}
+		if newer[k] < journalKeepPerHost {
+			newer[k]++
+			keep[idx] = true
+		}
+	}
+	var (
+		kept []journalEntry
+		buf  bytes.Buffer
+	)
+	for idx, e := range entries {
+		if !keep[idx] {
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(b, '\n'))
+		kept = append(kept, e)
+	}
+	tmp := *journalPath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, *journalPath); err != nil {
+		return nil, err
+	}
+	journalLines, journalKept = len(kept), len(kept)
+	return kept, nil
+}
+
+// loadJournal compacts the journal and restores the per-host metrics from it.
+func loadJournal() error {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	entries, err := compactJournal()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.updateMetrics()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalCompaction(t *testing.T) {
+	defer func(old string) { *journalPath = old }(*journalPath)
+	*journalPath = filepath.Join(t.TempDir(), "journal.jsonl")
+	defer func(lines, kept int) { journalLines, journalKept = lines, kept }(journalLines, journalKept)
+	journalLines, journalKept = 0, 0
+
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	for i := range 100 {
+		recordRun(journalEntry{
+			Kind:        "backup",
+			Source:      "midna",
+			Destination: "storage2",
+			Start:       start.Add(time.Duration(i) * time.Hour),
+			End:         start.Add(time.Duration(i)*time.Hour + time.Minute),
+		})
+		if i%10 == 0 {
+			recordRun(journalEntry{
+				Kind:        "backup",
+				Source:      "verkaufg9",
+				Destination: "storage2",
+				Start:       start.Add(time.Duration(i) * time.Hour),
+			})
+		}
+		entries, err := readJournal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// At most twice the number of entries to keep (of both hosts).
+		if max := 2 * (journalKeepPerHost + 10); len(entries) > max {
+			t.Fatalf("journal grew to %d entries, want at most %d", len(entries), max)
+		}
+	}
+
+	if err := loadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := make(map[string]int)
+	for _, e := range entries {
+		count[e.Source]++
+	}
+	if got, want := count["midna"], journalKeepPerHost; got != want {
+		t.Errorf("journal contains %d entries of midna, want %d", got, want)
+	}
+	// Hosts with few entries keep all of them.
+	if got, want := count["verkaufg9"], 10; got != want {
+		t.Errorf("journal contains %d entries of verkaufg9, want %d", got, want)
+	}
+	// The most recent entries are kept, in order.
+	if got, want := entries[len(entries)-1].Start, start.Add(99*time.Hour); !got.Equal(want) {
+		t.Errorf("last journal entry started at %v, want %v", got, want)
+	}
+}
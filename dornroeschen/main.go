@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -15,6 +16,7 @@ import (
 	"github.com/gokrazy/gokrazy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stapelberg/zkj-nas-tools/internal/wake"
 
 	_ "net/http/pprof"
 )
@@ -22,7 +24,7 @@ import (
 var (
 	listen = flag.String("listen",
 		":8014",
-		"[host]:port to listen on (for prometheus HTTP exports)")
+		"[host]:port to listen on (for prometheus HTTP exports, the status page and the control API)")
 
 	lastSuccessPath = flag.String("last_success_path",
 		"/perm/dr-last-success.txt",
@@ -31,6 +33,10 @@ var (
 	opportunisticBackupHosts = flag.String("opportunistic_backup_hosts",
 		"verkaufg9",
 		"Comma-separated list of hosts to back up when they become reachable")
+
+	hostsFile = flag.String("hosts_file",
+		"/perm/wake-hosts.json",
+		"host inventory file (JSON), re-loaded on SIGHUP; the built-in inventory is used if it does not exist")
 )
 
 var lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -58,49 +64,66 @@ func loadLastSuccess() error {
 func main() {
 	flag.Parse()
 
+	var err error
+	sshOverridesByHost, err = parseSSHOverrides(*sshOverrides)
+	if err != nil {
+		log.Fatalf("-ssh_overrides: %v", err)
+	}
+
+	// Pin the host keys of readiness probes and apply -ssh_overrides to them,
+	// too.
+	wake.SSHHostKeyCallback = verifyHostKey
+	wake.SSHHostKeyAlgorithms = hostKeyAlgorithms
+	wake.SSHAddr = probeSSHAddr
+
+	if *dramaqueenLeaseTTL <= 0 {
+		log.Fatalf("-dramaqueen_lease_ttl=%v must be positive", *dramaqueenLeaseTTL)
+	}
+
+	if err := wake.LoadHostsAndWatch(*hostsFile); err != nil {
+		log.Fatal(err)
+	}
+
 	gokrazy.WaitForClock()
 
 	if err := loadLastSuccess(); err != nil {
 		log.Printf("could not load last success timestamp from disk: %v", err)
 	}
+	if err := loadJournal(); err != nil {
+		log.Printf("could not load journal from disk: %v", err)
+	}
+
+	// ctx is canceled on SIGTERM, which cancels all backups and syncs.
+	ctx, shutdown := context.WithCancelCause(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM)
+		sig := <-c
+		log.Printf("received %v, canceling running jobs", sig)
+		shutdown(fmt.Errorf("received %v", sig))
+	}()
 
+	runCh := make(chan runRequest)
 	http.Handle("/metrics", promhttp.Handler())
+	registerHandlers(runCh)
 	go http.ListenAndServe(*listen, nil)
 
-	runCh := make(chan struct{})
-	go func() {
-		// Run forever, trigger a run at 10:00 each Monday through Friday.
-		for {
-			now := time.Now()
-			runToday := now.Hour() < 10 &&
-				now.Weekday() != time.Saturday &&
-				now.Weekday() != time.Sunday
-			today := now.Day()
-			log.Printf("now = %v, runToday = %v", now, runToday)
-			for {
-				if time.Now().Day() != today {
-					// Day changed, re-evaluate whether to run today.
-					break
-				}
-
-				nextHour := time.Now().Truncate(time.Hour).Add(1 * time.Hour)
-				log.Printf("today = %d, runToday = %v, next hour: %v", today, runToday, nextHour)
-				time.Sleep(time.Until(nextHour))
-
-				if time.Now().Hour() >= 10 && runToday {
-					runToday = false
-					runCh <- struct{}{}
-				}
-			}
-		}
-	}()
+	if err := loadRetryPolicies(); err != nil {
+		log.Fatal(err)
+	}
+
+	schedules, err := loadSchedules()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startSchedules(schedules, runCh)
 
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGUSR1)
 		for range c {
 			log.Printf("received SIGUSR1, starting run")
-			runCh <- struct{}{}
+			runCh <- runRequest{job: "run"}
 		}
 	}()
 
@@ -111,12 +134,49 @@ func main() {
 		}
 	}()
 
-	go runOpportunisticBackups(*opportunisticBackupHosts)
-
-	for range runCh {
-		log.Println("Running dornröschen")
-		if err := run(); err != nil {
+	opportunisticDone := make(chan struct{})
+	go runOpportunisticBackups(ctx, *opportunisticBackupHosts, func() { close(opportunisticDone) })
+
+	for {
+		var req runRequest
+		select {
+		case <-ctx.Done():
+			<-opportunisticDone
+			suspendPending()
+			log.Printf("exiting: %v", context.Cause(ctx))
+			return
+		case req = <-runCh:
+		}
+		log.Printf("Running dornröschen: %v", req)
+		start := time.Now()
+		runCtx, cancel := context.WithCancelCause(ctx)
+		runCtx, cancelTimeout := context.WithTimeoutCause(runCtx, *runTimeout,
+			fmt.Errorf("%v exceeded -run_timeout=%v", req, *runTimeout))
+		beginRun(req.String(), cancel)
+		var err error
+		switch req.job {
+		case "backup":
+			err = backupHostList(runCtx, req.hosts)
+		case "sync":
+			err = sync(runCtx, strings.Split(*storageHosts, ","))
+		case "retry":
+			err = retryFailedBackups(runCtx)
+		default:
+			err = run(runCtx)
+		}
+		finishRun(runCtx, err)
+		cancelTimeout()
+		cancel(nil)
+		if req.schedule != "" && ctx.Err() == nil {
+			// Runs interrupted by SIGTERM are caught up after the restart.
+			recordScheduledRun(req.schedule, start)
+		}
+		if err != nil {
 			log.Printf("failed: %v", err)
+			continue
+		}
+		if req.job != "run" {
+			continue
 		}
 		unix := time.Now().Unix()
 		lastSuccess.Set(float64(unix))
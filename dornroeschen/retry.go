@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+var (
+	retryPolicyFile = flag.String("retry_policy_file",
+		"/perm/dr-retry.json",
+		"Retry policy file (JSON) with a default policy and per-host overrides; if it does not exist, failed backups are attempted 3 times with exponential backoff starting at 5 minutes")
+	retryGrace = flag.Duration("retry_grace",
+		30*time.Minute,
+		"How long to keep a NAS running after backups to it failed, so that a retry job can back up the failed hosts without waking up the NAS again (0 = suspend immediately)")
+)
+
+// Failure classes of a backup, see backupError.
+const (
+	failureWake     = "wake"     // the source host could not be woken up
+	failureLock     = "lock"     // the dramaqueen lock is held by somebody else
+	failureSSH      = "ssh"      // rsync could not be started via SSH
+	failureRsync    = "rsync"    // rsync exited with a non-zero exit code
+	failureTimeout  = "timeout"  // -host_timeout was exceeded
+	failureCanceled = "canceled" // the run was canceled, never retried
+)
+
+// backupError is returned by backup1 to classify failures for retryPolicy.
+type backupError struct {
+	class string
+	err   error
+}
+
+func (e *backupError) Error() string { return e.err.Error() }
+func (e *backupError) Unwrap() error { return e.err }
+
+// retryPolicy configures whether and when to retry a failed backup of a host.
+// Zero fields are inherited from the default policy.
+type retryPolicy struct {
+	// Attempts is the total number of attempts, including the first.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the delay before the first retry (e.g. "5m"), doubled for
+	// each further retry up to MaxBackoff.
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// RetryOn lists the failure classes to retry: wake, lock, ssh, rsync,
+	// timeout.
+	RetryOn []string `json:"retry_on,omitempty"`
+
+	backoff, maxBackoff time.Duration
+}
+
+type retryConfig struct {
+	Default retryPolicy            `json:"default"`
+	Hosts   map[string]retryPolicy `json:"hosts,omitempty"`
+}
+
+var defaultRetryPolicy = retryPolicy{
+	Attempts:   3,
+	Backoff:    "5m",
+	MaxBackoff: "30m",
+	RetryOn:    []string{failureWake, failureLock, failureSSH, failureRsync},
+}
+
+// retryPolicies is set by loadRetryPolicies.
+var retryPolicies = retryConfig{Default: defaultRetryPolicy}
+
+// merge returns p with zero fields set from def.
+func (p retryPolicy) merge(def retryPolicy) retryPolicy {
+	if p.Attempts == 0 {
+		p.Attempts = def.Attempts
+	}
+	if p.Backoff == "" {
+		p.Backoff = def.Backoff
+	}
+	if p.MaxBackoff == "" {
+		p.MaxBackoff = def.MaxBackoff
+	}
+	if p.RetryOn == nil {
+		p.RetryOn = def.RetryOn
+	}
+	return p
+}
+
+func (p *retryPolicy) parse() error {
+	if p.Attempts < 1 {
+		return fmt.Errorf("attempts must be at least 1")
+	}
+	var err error
+	if p.backoff, err = time.ParseDuration(p.Backoff); err != nil {
+		return err
+	}
+	if p.maxBackoff, err = time.ParseDuration(p.MaxBackoff); err != nil {
+		return err
+	}
+	for _, class := range p.RetryOn {
+		switch class {
+		case failureWake, failureLock, failureSSH, failureRsync, failureTimeout:
+		default:
+			return fmt.Errorf("unknown failure class %q in retry_on (expected wake, lock, ssh, rsync or timeout)", class)
+		}
+	}
+	return nil
+}
+
+func loadRetryPolicies() error {
+	b, err := os.ReadFile(*retryPolicyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return retryPolicies.Default.parse()
+		}
+		return err
+	}
+	var cfg retryConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("%s: %v", *retryPolicyFile, err)
+	}
+	cfg.Default = cfg.Default.merge(defaultRetryPolicy)
+	if err := cfg.Default.parse(); err != nil {
+		return fmt.Errorf("%s: default: %v", *retryPolicyFile, err)
+	}
+	for host, p := range cfg.Hosts {
+		p = p.merge(cfg.Default)
+		if err := p.parse(); err != nil {
+			return fmt.Errorf("%s: host %s: %v", *retryPolicyFile, host, err)
+		}
+		cfg.Hosts[host] = p
+	}
+	retryPolicies = cfg
+	return nil
+}
+
+func retryPolicyFor(host string) retryPolicy {
+	if p, ok := retryPolicies.Hosts[host]; ok {
+		return p
+	}
+	return retryPolicies.Default
+}
+
+func (p retryPolicy) retryable(err error) bool {
+	be, ok := err.(*backupError)
+	return ok && slices.Contains(p.RetryOn, be.class)
+}
+
+// delay returns how long to wait before the retry following attempt.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.maxBackoff)
+}
+
+// backupWithRetries backs up sourceHost, retrying according to its
+// retryPolicy.
+func backupWithRetries(ctx context.Context, t *task, destHost, sourceHost, sourceMAC string) (err error) {
+	defer func() { t.finish(ctx, err) }()
+	policy := retryPolicyFor(sourceHost)
+	// The state is kept across attempts so that the host is suspended after
+	// a successful retry if the first attempt woke it up, and so that the
+	// destination NAS keeps running while waiting to retry.
+	var st backupState
+	defer func() {
+		if st.lease != nil {
+			releaseDramaqueenLock(destHost, backupLockName(sourceHost), st.lease)
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		err = backup1(ctx, t, attempt, &st, destHost, sourceHost, sourceMAC)
+		if err == nil {
+			return nil
+		}
+		if attempt >= policy.Attempts || !policy.retryable(err) {
+			return err
+		}
+		delay := policy.delay(attempt)
+		log.Printf("[%s] attempt %d/%d failed, retrying in %v: %v", sourceHost, attempt, policy.Attempts, delay, err)
+		fmt.Fprintf(t.output, "--- attempt %d/%d failed, retrying in %v: %v\n", attempt, policy.Attempts, delay, err)
+		t.setPhase(fmt.Sprintf("retrying at %s (attempt %d/%d failed)", time.Now().Add(delay).Format("15:04"), attempt, policy.Attempts))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+var (
+	pendingSuspendMu gosync.Mutex
+	// pendingSuspend contains the NASen which are kept running for
+	// -retry_grace because backups to them failed.
+	pendingSuspend = make(map[string]*time.Timer)
+)
+
+// takePendingSuspend returns whether destHost was kept running for retries,
+// in which case the caller is now responsible for suspending it.
+func takePendingSuspend(destHost string) bool {
+	pendingSuspendMu.Lock()
+	defer pendingSuspendMu.Unlock()
+	timer, ok := pendingSuspend[destHost]
+	if ok {
+		timer.Stop()
+		delete(pendingSuspend, destHost)
+	}
+	return ok
+}
+
+// releaseNAS suspends destHost after backing up to it, if it was woken up for
+// the backup (or kept running for retries). If backups to destHost failed,
+// suspending is delayed by -retry_grace, so that a retry job can use the NAS.
+func releaseNAS(destHost string, woken bool) {
+	if pending := takePendingSuspend(destHost); !woken && !pending {
+		return
+	}
+	if failed := failedBackups()[destHost]; *retryGrace > 0 && len(failed) > 0 {
+		log.Printf("backups of %s to %s failed, suspending %s in %v unless retried",
+			strings.Join(failed, ", "), destHost, destHost, *retryGrace)
+		pendingSuspendMu.Lock()
+		defer pendingSuspendMu.Unlock()
+		pendingSuspend[destHost] = time.AfterFunc(*retryGrace, func() {
+			if takePendingSuspend(destHost) {
+				suspendNAS(destHost)
+			}
+		})
+		return
+	}
+	suspendNAS(destHost)
+}
+
+// suspendPending suspends all NASen which are kept running for retries, e.g.
+// when exiting.
+func suspendPending() {
+	pendingSuspendMu.Lock()
+	var hosts []string
+	for destHost := range pendingSuspend {
+		hosts = append(hosts, destHost)
+	}
+	pendingSuspendMu.Unlock()
+	for _, destHost := range hosts {
+		if takePendingSuspend(destHost) {
+			suspendNAS(destHost)
+		}
+	}
+}
+
+// failedBackups returns the hosts whose most recent backup failed, keyed by
+// backup destination. Canceled backups (e.g. by SIGTERM or via the API) are
+// not included, as they are never retried.
+func failedBackups() map[string][]string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	failed := make(map[string][]string)
+	for _, t := range tasks {
+		if t.Kind != "backup" || t.Phase != phaseFailed {
+			continue
+		}
+		failed[t.Destination] = append(failed[t.Destination], t.Source)
+	}
+	for _, sources := range failed {
+		sort.Strings(sources)
+	}
+	return failed
+}
+
+// retryFailedBackups backs up all hosts whose most recent backup failed
+// again, to the same destination (which is typically still running, see
+// releaseNAS).
+func retryFailedBackups(ctx context.Context) error {
+	failed := failedBackups()
+	if len(failed) == 0 {
+		log.Printf("no failed backups to retry")
+		return nil
+	}
+	storageList := strings.Split(*storageHosts, ",")
+	var firstErr error
+	for destHost, hosts := range failed {
+		idx := slices.IndexFunc(storageList, func(nas string) bool {
+			host, _ := splitHostMAC(nas)
+			return host == destHost
+		})
+		if idx == -1 {
+			log.Printf("not retrying backups of %s: destination %s is not in -storage_hosts", strings.Join(hosts, ", "), destHost)
+			continue
+		}
+		var sources []string
+		for _, host := range hosts {
+			if source, ok := backupSource(host); ok {
+				sources = append(sources, source)
+			}
+		}
+		log.Printf("retrying backups of %s to %s", strings.Join(hosts, ", "), destHost)
+		woken, err := backup(ctx, storageList[idx], sources)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		releaseNAS(destHost, woken)
+	}
+	return firstErr
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+var (
+	destinationPolicy = flag.String("destination_policy",
+		"day",
+		"How to pick the backup destination among -storage_hosts: day (round-robin by day of month), lru (least recently used) or most_free (most free space among reachable NASen, falling back to lru)")
+	destinationStatePath = flag.String("destination_state_path",
+		"/perm/dr-destinations.json",
+		"Path to a file in which to store when each NAS was last used as backup destination (for -destination_policy=lru)")
+	dfPrivateKeyPath = flag.String("ssh_df_private_key_path",
+		"/perm/id_ed25519_df",
+		"Path to the SSH private key file to authenticate with at -storage_hosts for querying free space (for -destination_policy=most_free). The key should be restricted to a command printing the available bytes, e.g. df --output=avail -B1 /srv/backups")
+	syncTopology = flag.String("sync_topology",
+		"ring",
+		"How to sync -storage_hosts: ring (each NAS to the next), star (all NASen to -sync_hub, then -sync_hub to all NASen) or mesh (each NAS to every other NAS)")
+	syncHub = flag.String("sync_hub",
+		"",
+		"Hub for -sync_topology=star (host part of a -storage_hosts entry, default the first NAS)")
+)
+
+var destinationStateMu gosync.Mutex
+
+func loadDestinationState() (map[string]time.Time, error) {
+	state := make(map[string]time.Time)
+	b, err := os.ReadFile(*destinationStatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", *destinationStatePath, err)
+	}
+	return state, nil
+}
+
+// recordDestination persists that destHost was just used as backup
+// destination, for -destination_policy=lru.
+func recordDestination(destHost string) {
+	destinationStateMu.Lock()
+	defer destinationStateMu.Unlock()
+	state, err := loadDestinationState()
+	if err != nil {
+		log.Printf("could not load destination state: %v", err)
+		state = make(map[string]time.Time)
+	}
+	state[destHost] = time.Now()
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("could not persist destination state: %v", err)
+		return
+	}
+	if err := os.WriteFile(*destinationStatePath, b, 0600); err != nil {
+		log.Printf("could not persist destination state: %v", err)
+	}
+}
+
+func leastRecentlyUsed(storageList []string) string {
+	destinationStateMu.Lock()
+	state, err := loadDestinationState()
+	destinationStateMu.Unlock()
+	if err != nil {
+		log.Printf("could not load destination state, falling back to day policy: %v", err)
+		return byDay(storageList)
+	}
+	var (
+		lru     string
+		lruTime time.Time
+	)
+	for _, nas := range storageList {
+		host, _ := splitHostMAC(nas)
+		if t := state[host]; lru == "" || t.Before(lruTime) {
+			lru, lruTime = nas, t
+		}
+	}
+	return lru
+}
+
+// Alternate between the available NASen to make sure each one works.
+func byDay(storageList []string) string {
+	return storageList[(time.Now().Day()+1)%len(storageList)]
+}
+
+// dfTimeout bounds querying the free space of a NAS, so that a hung NAS does
+// not block picking the backup destination.
+const dfTimeout = 30 * time.Second
+
+// freeBytes returns the free space reported by host for the
+// -ssh_df_private_key_path key, which is expected to print a number of bytes
+// as last line (like df --output=avail -B1 does).
+func freeBytes(ctx context.Context, host string) (int64, error) {
+	ctx, canc := context.WithTimeoutCause(ctx, dfTimeout,
+		fmt.Errorf("querying free space of %s timed out after %v", host, dfTimeout))
+	defer canc()
+	out, err := sshOutput(ctx, host, *dfPrivateKeyPath, "")
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return strconv.ParseInt(strings.TrimSpace(lines[len(lines)-1]), 0, 64)
+}
+
+func mostFree(ctx context.Context, storageList []string) string {
+	var (
+		best     string
+		bestFree int64 = -1
+	)
+	for _, nas := range storageList {
+		host, _ := splitHostMAC(nas)
+		if !reachableViaSSH(host) {
+			log.Printf("[%s] not reachable, not considering for most_free", host)
+			continue
+		}
+		free, err := freeBytes(ctx, host)
+		if err != nil {
+			log.Printf("[%s] querying free space: %v", host, err)
+			continue
+		}
+		log.Printf("[%s] %d bytes free", host, free)
+		if free > bestFree {
+			best, bestFree = nas, free
+		}
+	}
+	if best == "" {
+		log.Printf("no reachable NAS reported free space, falling back to lru policy")
+		return leastRecentlyUsed(storageList)
+	}
+	return best
+}
+
+// pickDestination returns the backup destination (host/MAC entry of
+// storageList) according to -destination_policy.
+func pickDestination(ctx context.Context, storageList []string) (string, error) {
+	if len(storageList) == 0 {
+		return "", fmt.Errorf("no -storage_hosts configured")
+	}
+	switch *destinationPolicy {
+	case "day":
+		return byDay(storageList), nil
+	case "lru":
+		return leastRecentlyUsed(storageList), nil
+	case "most_free":
+		return mostFree(ctx, storageList), nil
+	default:
+		return "", fmt.Errorf("unknown -destination_policy %q", *destinationPolicy)
+	}
+}
+
+// syncPair is one rsync invocation from source to dest (host/MAC entries).
+type syncPair struct {
+	source, dest string
+}
+
+// syncPairs returns the rsync invocations for syncing NASen according to
+// -sync_topology, in the order in which they should run.
+func syncPairs(NASen []string) ([]syncPair, error) {
+	if len(NASen) < 2 {
+		return nil, nil
+	}
+	var pairs []syncPair
+	switch *syncTopology {
+	case "ring":
+		for idx, source := range NASen {
+			pairs = append(pairs, syncPair{source, NASen[(idx+1)%len(NASen)]})
+		}
+
+	case "star":
+		hub := NASen[0]
+		if *syncHub != "" {
+			hub = ""
+			for _, nas := range NASen {
+				if host, _ := splitHostMAC(nas); host == *syncHub {
+					hub = nas
+				}
+			}
+			if hub == "" {
+				return nil, fmt.Errorf("-sync_hub=%q is not in -storage_hosts", *syncHub)
+			}
+		}
+		// First collect everything on the hub, then distribute it.
+		for _, nas := range NASen {
+			if nas != hub {
+				pairs = append(pairs, syncPair{nas, hub})
+			}
+		}
+		for _, nas := range NASen {
+			if nas != hub {
+				pairs = append(pairs, syncPair{hub, nas})
+			}
+		}
+
+	case "mesh":
+		for _, source := range NASen {
+			for _, dest := range NASen {
+				if source != dest {
+					pairs = append(pairs, syncPair{source, dest})
+				}
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown -sync_topology %q", *syncTopology)
+	}
+	return pairs, nil
+}
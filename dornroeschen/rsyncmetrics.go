@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pushgateway = flag.String("pushgateway",
+		"https://pushgateway.monkey-turtle.ts.net",
+		"URL of a Prometheus Pushgateway to push rsync metrics to; set to empty to disable pushing. rsync metrics are exported on -listen regardless.")
+	pushgatewayJob = flag.String("pushgateway_job",
+		"rsync",
+		"Prometheus job label for metrics pushed to -pushgateway")
+	pushgatewayInstance = flag.String("pushgateway_instance",
+		"dr@{source}:{destination}",
+		"Prometheus instance label for metrics pushed to -pushgateway; {source} and {destination} are replaced by the hosts")
+)
+
+func pushgatewayInstanceFor(sourceHost, destHost string) string {
+	return strings.NewReplacer(
+		"{source}", sourceHost,
+		"{destination}", destHost,
+	).Replace(*pushgatewayInstance)
+}
+
+// The same metrics which rsyncprom.WrapRsync pushes to the Pushgateway, but
+// with one time series per backup/sync.
+var (
+	rsyncTotalWritten = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_total_written",
+		Help: "Total bytes written in the last transfer",
+	}, hostLabels)
+	rsyncTotalRead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_total_read",
+		Help: "Total bytes read in the last transfer",
+	}, hostLabels)
+	rsyncBytesPerSec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_bytes_per_sec",
+		Help: "Bytes per second of the last transfer",
+	}, hostLabels)
+	rsyncTotalSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_total_size",
+		Help: "Total size of all processed files in the last transfer, in bytes",
+	}, hostLabels)
+	rsyncSpeedup = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_speedup",
+		Help: "Speed-up of the last transfer over copying all files (total size divided by bytes written and read)",
+	}, hostLabels)
+	rsyncExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rsync_exit_code",
+		Help: "rsync exit code of the last transfer (0 = success, 24 = success, but some files vanished)",
+	}, hostLabels)
+)
+
+func init() {
+	prometheus.MustRegister(rsyncTotalWritten)
+	prometheus.MustRegister(rsyncTotalRead)
+	prometheus.MustRegister(rsyncBytesPerSec)
+	prometheus.MustRegister(rsyncTotalSize)
+	prometheus.MustRegister(rsyncSpeedup)
+	prometheus.MustRegister(rsyncExitCode)
+}
+
+func updateRsyncMetrics(kind, sourceHost, destHost string, res rsyncResult) {
+	labels := prometheus.Labels{
+		"kind":        kind,
+		"source":      sourceHost,
+		"destination": destHost,
+	}
+	rsyncExitCode.With(labels).Set(float64(res.ExitCode))
+	stats := res.Stats
+	if stats == nil {
+		return
+	}
+	rsyncTotalWritten.With(labels).Set(float64(stats.TotalWritten))
+	rsyncTotalRead.With(labels).Set(float64(stats.TotalRead))
+	rsyncBytesPerSec.With(labels).Set(stats.BytesPerSec)
+	rsyncTotalSize.With(labels).Set(float64(stats.TotalSize))
+	if transferred := stats.TotalWritten + stats.TotalRead; transferred > 0 {
+		rsyncSpeedup.With(labels).Set(float64(stats.TotalSize) / float64(transferred))
+	}
+}
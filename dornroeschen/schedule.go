@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scheduleFile = flag.String("schedule_file",
+		"/perm/dr-schedule.json",
+		"Schedule file (JSON) defining when to run which job; if it does not exist, a full run is scheduled at 10:00 Monday through Friday")
+	scheduleStatePath = flag.String("schedule_state_path",
+		"/perm/dr-schedule-state.json",
+		"Path to a file in which to store when each schedule last ran (for catching up on missed runs)")
+)
+
+// blackout is a time window during which scheduled runs are postponed.
+type blackout struct {
+	// Weekdays are English three-letter abbreviations (mon, tue, …) of the
+	// days on which the window starts. Empty means every day.
+	Weekdays []string `json:"weekdays,omitempty"`
+	// Start and End are in HH:MM format (local time). If End is not after
+	// Start, the window extends into the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	days       [7]bool
+	start, end time.Duration // since midnight
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (b *blackout) parse() error {
+	var err error
+	if b.start, err = parseClock(b.Start); err != nil {
+		return err
+	}
+	if b.end, err = parseClock(b.End); err != nil {
+		return err
+	}
+	if len(b.Weekdays) == 0 {
+		for i := range b.days {
+			b.days[i] = true
+		}
+	}
+	for _, day := range b.Weekdays {
+		idx, err := parseCronValue(day, dowNames)
+		if err != nil || idx < 0 || idx > 6 {
+			return fmt.Errorf("invalid weekday %q", day)
+		}
+		b.days[idx] = true
+	}
+	return nil
+}
+
+// until returns when the blackout window containing t ends, or the zero time
+// if t is not within the window.
+func (b *blackout) until(t time.Time) time.Time {
+	y, m, d := t.Date()
+	// A window which extends into the next day could have started yesterday.
+	for _, offset := range []int{0, -1} {
+		midnight := time.Date(y, m, d+offset, 0, 0, 0, 0, t.Location())
+		if !b.days[midnight.Weekday()] {
+			continue
+		}
+		end := b.end
+		if end <= b.start {
+			end += 24 * time.Hour
+		}
+		from := midnight.Add(b.start)
+		to := midnight.Add(end)
+		if !t.Before(from) && t.Before(to) {
+			return to
+		}
+	}
+	return time.Time{}
+}
+
+// schedule triggers a job according to a cron expression.
+type schedule struct {
+	Name string `json:"name"`
+	Job  string `json:"job"` // run, backup, sync or retry
+	// Hosts to back up (for job backup). Empty means all -backup_hosts.
+	Hosts []string `json:"hosts,omitempty"`
+	// Cron is a cron expression (minute hour day-of-month month day-of-week)
+	// in local time, e.g. "0 10 * * mon-fri".
+	Cron string `json:"cron"`
+	// Jitter is the maximum random delay (e.g. "15m") by which to delay each
+	// run, to not start all jobs at the same time.
+	Jitter string `json:"jitter,omitempty"`
+	// CatchUp runs the job as soon as possible if a run was missed, e.g.
+	// because the machine was turned off at the scheduled time. Multiple
+	// missed runs result in only one catch-up run.
+	CatchUp   bool       `json:"catch_up,omitempty"`
+	Blackouts []blackout `json:"blackouts,omitempty"`
+
+	cron   *cronSchedule
+	jitter time.Duration
+}
+
+type scheduleConfig struct {
+	Schedules []*schedule `json:"schedules"`
+	// Blackouts apply to all schedules.
+	Blackouts []blackout `json:"blackouts,omitempty"`
+}
+
+// defaultSchedules corresponds to how dornröschen was run before schedules
+// were configurable.
+var defaultSchedules = scheduleConfig{
+	Schedules: []*schedule{
+		{
+			Name:    "daily",
+			Job:     "run",
+			Cron:    "0 10 * * mon-fri",
+			CatchUp: true,
+		},
+	},
+}
+
+func loadSchedules() ([]*schedule, error) {
+	cfg := defaultSchedules
+	b, err := os.ReadFile(*scheduleFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		cfg = scheduleConfig{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", *scheduleFile, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, s := range cfg.Schedules {
+		s.Blackouts = append(s.Blackouts, cfg.Blackouts...)
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("%s: schedule %q: %v", *scheduleFile, s.Name, err)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("%s: duplicate schedule name %q", *scheduleFile, s.Name)
+		}
+		names[s.Name] = true
+	}
+	return cfg.Schedules, nil
+}
+
+func (s *schedule) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	switch s.Job {
+	case "run", "sync", "retry":
+		if len(s.Hosts) > 0 {
+			return fmt.Errorf("hosts can only be specified for job backup")
+		}
+	case "backup":
+		for _, host := range s.Hosts {
+			if _, ok := backupSource(host); !ok {
+				return fmt.Errorf("host %q is neither in -backup_hosts nor in -opportunistic_backup_hosts", host)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown job %q (expected run, backup, sync or retry)", s.Job)
+	}
+	var err error
+	if s.cron, err = parseCron(s.Cron); err != nil {
+		return err
+	}
+	if s.Jitter != "" {
+		if s.jitter, err = time.ParseDuration(s.Jitter); err != nil {
+			return err
+		}
+	}
+	for idx := range s.Blackouts {
+		if err := s.Blackouts[idx].parse(); err != nil {
+			return fmt.Errorf("blackout %d: %v", idx, err)
+		}
+	}
+	return nil
+}
+
+// postpone returns the first time not before t which is not within a
+// blackout window.
+func (s *schedule) postpone(t time.Time) time.Time {
+	for changed := true; changed; {
+		changed = false
+		for idx := range s.Blackouts {
+			if until := s.Blackouts[idx].until(t); !until.IsZero() {
+				t, changed = until, true
+			}
+		}
+	}
+	return t
+}
+
+var scheduleLabels = []string{"schedule", "job"}
+
+var (
+	scheduleNextRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "schedule_next_run",
+		Help: "Timestamp of the next run of a schedule",
+	}, scheduleLabels)
+	scheduleLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "schedule_last_run",
+		Help: "Timestamp of the last run of a schedule",
+	}, scheduleLabels)
+)
+
+func init() {
+	prometheus.MustRegister(scheduleNextRun)
+	prometheus.MustRegister(scheduleLastRun)
+}
+
+// scheduleStatus is shown on the status page.
+type scheduleStatus struct {
+	Name string    `json:"name"`
+	Job  string    `json:"job"`
+	Cron string    `json:"cron"`
+	Last time.Time `json:"last,omitzero"`
+	Next time.Time `json:"next,omitzero"`
+}
+
+var (
+	scheduleStateMu gosync.Mutex
+	scheduleState   = make(map[string]*scheduleStatus)
+)
+
+func loadScheduleState() (map[string]time.Time, error) {
+	state := make(map[string]time.Time)
+	b, err := os.ReadFile(*scheduleStatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", *scheduleStatePath, err)
+	}
+	return state, nil
+}
+
+// recordScheduledRun persists that the run of the named schedule which was
+// started at start has finished.
+func recordScheduledRun(name string, start time.Time) {
+	scheduleStateMu.Lock()
+	defer scheduleStateMu.Unlock()
+	if st, ok := scheduleState[name]; ok {
+		st.Last = start
+		scheduleLastRun.WithLabelValues(st.Name, st.Job).Set(float64(start.Unix()))
+	}
+	state, err := loadScheduleState()
+	if err != nil {
+		log.Printf("could not load schedule state: %v", err)
+		state = make(map[string]time.Time)
+	}
+	state[name] = start
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("could not persist schedule state: %v", err)
+		return
+	}
+	if err := os.WriteFile(*scheduleStatePath, b, 0600); err != nil {
+		log.Printf("could not persist schedule state: %v", err)
+	}
+}
+
+func setNextRun(s *schedule, next time.Time) {
+	scheduleStateMu.Lock()
+	defer scheduleStateMu.Unlock()
+	scheduleState[s.Name].Next = next
+	scheduleNextRun.WithLabelValues(s.Name, s.Job).Set(float64(next.Unix()))
+}
+
+func currentSchedules() []scheduleStatus {
+	scheduleStateMu.Lock()
+	defer scheduleStateMu.Unlock()
+	var result []scheduleStatus
+	for _, st := range scheduleState {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// scheduleStart returns the time after which to look for the first run of s,
+// given when s last ran (the zero time if unknown).
+func (s *schedule) scheduleStart(last, now time.Time) time.Time {
+	if s.CatchUp && !last.IsZero() {
+		return last
+	}
+	// Without catch up, only runs scheduled from now on matter. On first
+	// start, runs scheduled earlier today are caught up.
+	if s.CatchUp {
+		y, m, d := now.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+	return now
+}
+
+// nextRun returns when s should run next, given that it last ran at last (see
+// scheduleStart), or the zero time if s never matches. Missed runs are run at
+// now, and runs are postponed until blackout windows end.
+func (s *schedule) nextRun(last, now time.Time) time.Time {
+	next := s.cron.next(last)
+	if next.IsZero() {
+		return next
+	}
+	if next.Before(now) {
+		log.Printf("schedule %q: catching up on run missed at %v", s.Name, next)
+		next = now.Round(0) // strip the monotonic clock reading for logging
+	}
+	if s.jitter > 0 {
+		next = next.Add(rand.N(s.jitter))
+	}
+	if postponed := s.postpone(next); !postponed.Equal(next) {
+		log.Printf("schedule %q: postponing run from %v to %v (blackout)", s.Name, next, postponed)
+		next = postponed
+	}
+	return next
+}
+
+// runSchedule sends a runRequest to runCh whenever s is due. last is when s
+// last ran (the zero time if unknown).
+func runSchedule(s *schedule, last time.Time, runCh chan<- runRequest) {
+	last = s.scheduleStart(last, time.Now())
+	for {
+		next := s.nextRun(last, time.Now())
+		if next.IsZero() {
+			log.Printf("schedule %q: %q never matches", s.Name, s.Cron)
+			return
+		}
+		setNextRun(s, next)
+		log.Printf("schedule %q: next run at %v", s.Name, next)
+		time.Sleep(time.Until(next))
+		runCh <- runRequest{
+			job:      s.Job,
+			hosts:    s.Hosts,
+			schedule: s.Name,
+		}
+		last = time.Now()
+	}
+}
+
+// startSchedules starts a goroutine per schedule.
+func startSchedules(schedules []*schedule, runCh chan<- runRequest) {
+	state, err := loadScheduleState()
+	if err != nil {
+		log.Printf("could not load schedule state: %v", err)
+		state = make(map[string]time.Time)
+	}
+	scheduleStateMu.Lock()
+	for _, s := range schedules {
+		st := &scheduleStatus{
+			Name: s.Name,
+			Job:  s.Job,
+			Cron: s.Cron,
+			Last: state[s.Name],
+		}
+		scheduleState[s.Name] = st
+		if !st.Last.IsZero() {
+			scheduleLastRun.WithLabelValues(s.Name, s.Job).Set(float64(st.Last.Unix()))
+		}
+	}
+	scheduleStateMu.Unlock()
+	for _, s := range schedules {
+		go runSchedule(s, state[s.Name], runCh)
+	}
+}
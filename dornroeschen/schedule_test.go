@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustSchedule(t *testing.T, s *schedule) *schedule {
+	t.Helper()
+	if s.Name == "" {
+		s.Name = "test"
+	}
+	if s.Job == "" {
+		s.Job = "run"
+	}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleStart(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 34, 0, 0, time.UTC)
+	last := time.Date(2026, 10, 13, 10, 0, 0, 0, time.UTC)
+	midnight := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		catchUp bool
+		last    time.Time
+		want    time.Time
+	}{
+		{false, time.Time{}, now},
+		{false, last, now}, // missed runs do not matter without catch up
+		{true, time.Time{}, midnight},
+		{true, last, last},
+	} {
+		s := mustSchedule(t, &schedule{Cron: "0 10 * * *", CatchUp: tt.catchUp})
+		if got := s.scheduleStart(tt.last, now); !got.Equal(tt.want) {
+			t.Errorf("catch_up=%v: scheduleStart(%v) = %v, want %v", tt.catchUp, tt.last, got, tt.want)
+		}
+	}
+}
+
+func TestNextRunCatchUp(t *testing.T) {
+	s := mustSchedule(t, &schedule{Cron: "0 10 * * *", CatchUp: true})
+	// Three runs were missed while dornröschen was not running, which
+	// results in one run right away.
+	now := time.Date(2026, 10, 16, 12, 34, 0, 0, time.UTC)
+	last := time.Date(2026, 10, 13, 10, 0, 0, 0, time.UTC)
+	if got := s.nextRun(s.scheduleStart(last, now), now); !got.Equal(now) {
+		t.Errorf("nextRun after missed runs = %v, want %v (now)", got, now)
+	}
+	// After the catch-up run, the next run is scheduled regularly.
+	want := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	if got := s.nextRun(now, now); !got.Equal(want) {
+		t.Errorf("nextRun after catching up = %v, want %v", got, want)
+	}
+
+	// Without catch up, the run earlier today is not made up for.
+	s = mustSchedule(t, &schedule{Cron: "0 10 * * *"})
+	if got := s.nextRun(s.scheduleStart(last, now), now); !got.Equal(want) {
+		t.Errorf("nextRun without catch up = %v, want %v", got, want)
+	}
+}
+
+func TestNextRunBlackout(t *testing.T) {
+	// 2026-10-16 is a Friday.
+	for _, tt := range []struct {
+		desc      string
+		cron      string
+		blackouts []blackout
+		last      time.Time
+		want      time.Time
+	}{
+		{
+			desc:      "outside of blackout",
+			cron:      "0 10 * * *",
+			blackouts: []blackout{{Start: "11:00", End: "12:00"}},
+			last:      time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want:      time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "postponed until blackout ends",
+			cron:      "0 10 * * *",
+			blackouts: []blackout{{Start: "09:00", End: "17:30"}},
+			last:      time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want:      time.Date(2026, 10, 16, 17, 30, 0, 0, time.UTC),
+		},
+		{
+			desc:      "blackout on other weekdays",
+			cron:      "0 10 * * *",
+			blackouts: []blackout{{Weekdays: []string{"mon", "tue"}, Start: "09:00", End: "17:30"}},
+			last:      time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want:      time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "overnight blackout started the day before",
+			cron:      "0 2 * * *",
+			blackouts: []blackout{{Weekdays: []string{"fri"}, Start: "22:00", End: "06:00"}},
+			last:      time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+			want:      time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			desc: "adjacent blackouts",
+			cron: "0 10 * * *",
+			blackouts: []blackout{
+				{Start: "09:00", End: "12:00"},
+				{Start: "12:00", End: "13:00"},
+			},
+			last: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC),
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := mustSchedule(t, &schedule{Cron: tt.cron, Blackouts: tt.blackouts})
+			if got := s.nextRun(tt.last, tt.last); !got.Equal(tt.want) {
+				t.Errorf("nextRun(%v) = %v, want %v", tt.last, got, tt.want)
+			}
+		})
+	}
+}
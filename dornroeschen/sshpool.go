@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	gosync "sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshDialTimeout bounds connecting and the SSH handshake.
+	sshDialTimeout = 30 * time.Second
+	// sshKeepaliveInterval is how often to check that idle connections are
+	// still alive (e.g. the host could have been suspended meanwhile).
+	sshKeepaliveInterval = 30 * time.Second
+	// sshIdleTimeout is how long to keep a connection without sessions open.
+	sshIdleTimeout = 5 * time.Minute
+)
+
+// sshClientKey identifies a cached connection: the same host might be
+// accessed with different keys (which are restricted to different commands).
+type sshClientKey struct {
+	host, keypath string
+}
+
+type sshClient struct {
+	*ssh.Client
+	key sshClientKey
+
+	// sessions and idle are guarded by sshPool.mu.
+	sessions int
+	idle     *time.Timer
+
+	closeOnce gosync.Once
+	done      chan struct{} // closed by close()
+}
+
+func (c *sshClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Client.Close()
+	})
+}
+
+// sshPool caches one SSH connection per host and key, so that the many SSH
+// sessions of a run (waking, backing up, suspending, …) do not each dial a new
+// connection.
+type sshPool struct {
+	mu      gosync.Mutex
+	clients map[sshClientKey]*sshClient
+}
+
+var sshClients = &sshPool{clients: make(map[sshClientKey]*sshClient)}
+
+func dialSSH(ctx context.Context, host, keypath string) (*ssh.Client, error) {
+	config, addr, err := sshClientConfig(host, keypath)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: sshDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The SSH handshake does not take a context, so bound it by a deadline.
+	deadline := time.Now().Add(sshDialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// get returns the cached connection for host and keypath, dialing a new one if
+// necessary. The caller must call release once done with the connection.
+func (p *sshPool) get(ctx context.Context, host, keypath string) (*sshClient, error) {
+	key := sshClientKey{host, keypath}
+	p.mu.Lock()
+	if c, ok := p.clients[key]; ok {
+		c.acquire()
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	// Dial without holding the lock, connecting can take a while.
+	cl, err := dialSSH(ctx, host, keypath)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[key]; ok {
+		// Another goroutine was faster, use its connection.
+		cl.Close()
+		c.acquire()
+		return c, nil
+	}
+	c := &sshClient{
+		Client: cl,
+		key:    key,
+		done:   make(chan struct{}),
+	}
+	p.clients[key] = c
+	c.acquire()
+	go p.keepalive(c)
+	go func() {
+		// Clean up when the connection breaks.
+		cl.Wait()
+		p.evict(c)
+	}()
+	return c, nil
+}
+
+// acquire must be called with sshPool.mu held.
+func (c *sshClient) acquire() {
+	c.sessions++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+}
+
+func (p *sshPool) release(c *sshClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.sessions--
+	if c.sessions > 0 {
+		return
+	}
+	c.idle = time.AfterFunc(sshIdleTimeout, func() {
+		p.mu.Lock()
+		idle := c.sessions == 0
+		p.mu.Unlock()
+		if idle {
+			p.evict(c)
+		}
+	})
+}
+
+// evict closes c and removes it from the cache.
+func (p *sshPool) evict(c *sshClient) {
+	p.mu.Lock()
+	if p.clients[c.key] == c {
+		delete(p.clients, c.key)
+	}
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	p.mu.Unlock()
+	c.close()
+}
+
+// closeHost closes all connections to host, e.g. before suspending it.
+func (p *sshPool) closeHost(host string) {
+	p.mu.Lock()
+	var evict []*sshClient
+	for key, c := range p.clients {
+		if key.host == host {
+			evict = append(evict, c)
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range evict {
+		p.evict(c)
+	}
+}
+
+// ping sends a keepalive request, failing if c does not respond within
+// sshKeepaliveInterval.
+func (c *sshClient) ping() error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(sshKeepaliveInterval):
+		return errors.New("keepalive timed out")
+	case <-c.done:
+		return errors.New("connection closed")
+	}
+}
+
+func (p *sshPool) keepalive(c *sshClient) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		err := c.ping()
+		if err == nil {
+			continue
+		}
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		log.Printf("ssh(%s): keepalive failed: %v", c.key.host, err)
+		// Closing the connection unblocks SendRequest.
+		p.evict(c)
+		return
+	}
+}
+
+// newSession opens an SSH session to host. If the cached connection turns out
+// to be broken, it is discarded and a new connection is dialed. If it works,
+// but does not allow another session (e.g. OpenSSH's MaxSessions), the session
+// is opened on a separate connection, as the cached one might still be
+// carrying other sessions. The returned release function closes the session
+// and must be called once done.
+func (p *sshPool) newSession(ctx context.Context, host, keypath string) (*ssh.Session, func(), error) {
+	for attempt := 0; ; attempt++ {
+		c, err := p.get(ctx, host, keypath)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := c.NewSession()
+		if err != nil {
+			p.release(c)
+			if p.busy(c) {
+				if pingErr := c.ping(); pingErr == nil {
+					log.Printf("ssh(%s): new session: %v, using a separate connection", host, err)
+					return newUncachedSession(ctx, host, keypath)
+				}
+			}
+			p.evict(c)
+			if attempt == 0 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("ssh(%s): new session: %v", host, err)
+		}
+		var once gosync.Once
+		return session, func() {
+			once.Do(func() {
+				session.Close()
+				p.release(c)
+			})
+		}, nil
+	}
+}
+
+// busy returns whether c is in use by other sessions.
+func (p *sshPool) busy(c *sshClient) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return c.sessions > 0
+}
+
+// newUncachedSession opens an SSH session to host on a new connection, which
+// is closed together with the session.
+func newUncachedSession(ctx context.Context, host, keypath string) (*ssh.Session, func(), error) {
+	cl, err := dialSSH(ctx, host, keypath)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := cl.NewSession()
+	if err != nil {
+		cl.Close()
+		return nil, nil, fmt.Errorf("ssh(%s): new session: %v", host, err)
+	}
+	var once gosync.Once
+	return session, func() {
+		once.Do(func() {
+			session.Close()
+			cl.Close()
+		})
+	}, nil
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strings"
 
 	"github.com/stapelberg/rsyncprom"
 	"golang.org/x/crypto/ssh"
@@ -24,79 +24,105 @@ func openSshClientAuth(path string) (ssh.AuthMethod, error) {
 	return ssh.PublicKeys(signer), err
 }
 
-func newSshConnection(host, keypath string) (*ssh.Client, error) {
+// sshClientConfig returns the configuration for connecting to host with the
+// private key at keypath, and the address to connect to.
+func sshClientConfig(host, keypath string) (*ssh.ClientConfig, string, error) {
 	clientauth, err := openSshClientAuth(keypath)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
+	user, addr := sshTarget(host)
 	clientConfig := &ssh.ClientConfig{
-		User: "root",
+		User: user,
 		Auth: []ssh.AuthMethod{clientauth},
-		// Sending the backup destination IP address to an attacker is
-		// not a threat I’m worried about.
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		// Verify the host key so that a spoofed host on the LAN can neither
+		// learn the backup destination nor receive suspend commands.
+		HostKeyCallback:   verifyHostKey,
+		HostKeyAlgorithms: hostKeyAlgorithms(addr),
 	}
+	return clientConfig, addr, nil
+}
 
-	cl, err := ssh.Dial("tcp", host+":22", clientConfig)
-	if err != nil {
-		return nil, err
-	}
-	return cl, nil
+// logWriter logs each line written to it. Close waits until all lines were
+// logged.
+type logWriter struct {
+	*io.PipeWriter
+	done chan struct{}
 }
 
-func newLogWriter(logger *log.Logger) io.Writer {
+func (w *logWriter) Close() error {
+	err := w.PipeWriter.Close()
+	<-w.done
+	return err
+}
+
+func newLogWriter(logger *log.Logger) io.WriteCloser {
 	r, w := io.Pipe()
+	done := make(chan struct{})
 	scanner := bufio.NewScanner(r)
 	go func() {
+		defer close(done)
 		for scanner.Scan() {
 			logger.Printf("> %s", scanner.Text())
 		}
 		if err := scanner.Err(); err != nil && err != io.EOF {
 			log.Print(err)
 		}
+		// Keep draining so that writers never block.
+		io.Copy(io.Discard, r)
 	}()
-	return w
+	return &logWriter{PipeWriter: w, done: done}
 }
 
-func sshCommandFor(logger *log.Logger, session *ssh.Session, host, keypath, command string) (start func(context.Context, []string) (io.Reader, error), wait func() int) {
+// sshCommandFor returns functions to start command on host and to wait for it
+// to exit (returning the exit status of command), as expected by
+// rsyncprom.WrapRsync. The remote command is killed
+// when the context passed to start is canceled. The caller must read the
+// returned io.Reader until EOF.
+func sshCommandFor(logger *log.Logger, host, keypath, command string) (start func(context.Context, []string) (io.Reader, error), wait func() int) {
 	exitCode := make(chan int, 1)
-	return func(context.Context, []string) (io.Reader, error) {
+	return func(ctx context.Context, _ []string) (io.Reader, error) {
 			logger.Printf("ssh(%s)", host)
-			conn, err := newSshConnection(host, keypath)
-			if err != nil {
-				return nil, err
-			}
-			session, err = conn.NewSession()
+			session, release, err := sshClients.newSession(ctx, host, keypath)
 			if err != nil {
 				return nil, err
 			}
-			pr, pw, err := os.Pipe()
-			if err != nil {
-				return nil, err
-			}
-
-			session.Stdout = io.MultiWriter(pw, newLogWriter(logger))
-			session.Stderr = newLogWriter(logger)
+			pr, pw := io.Pipe()
+			stdoutLog := newLogWriter(logger)
+			stderrLog := newLogWriter(logger)
+			session.Stdout = io.MultiWriter(pw, stdoutLog)
+			session.Stderr = stderrLog
 			logger.Printf("(*ssh.Session).Start(%q)", command)
 			if err := session.Start(command); err != nil {
+				release()
+				stdoutLog.Close()
+				stderrLog.Close()
 				return nil, err
 			}
+			stop := context.AfterFunc(ctx, func() {
+				logger.Printf("killing remote command: %v", context.Cause(ctx))
+				session.Signal(ssh.SIGKILL)
+				session.Close()
+			})
 
 			go func() {
 				defer pw.Close()
-				if err := session.Wait(); err != nil {
+				err := session.Wait()
+				stop()
+				release()
+				stdoutLog.Close()
+				stderrLog.Close()
+				if err != nil {
 					logger.Printf("(*ssh.Session).Wait() = %v", err)
-					if strings.Contains(err.Error(), "exited with status 24") {
-						// rsync exits with status code 24 when a file or directory
-						// vanishes between listing and transferring it. this can be
-						// expected when doing a full backup while working with
-						// docker containers, for example, so treat an exit status
-						// code 24 as not-an-error:
-						exitCode <- 0
+					var exitErr *ssh.ExitError
+					if errors.As(err, &exitErr) {
+						exitCode <- exitErr.ExitStatus()
 						return
 					}
-					exitCode <- 1
+					// Like ssh(1), use 255 when the remote command did not
+					// report an exit status (e.g. the connection was lost).
+					exitCode <- 255
 					return
 				}
 				exitCode <- 0
@@ -108,41 +134,111 @@ func sshCommandFor(logger *log.Logger, session *ssh.Session, host, keypath, comm
 		}
 }
 
-func rsyncSSH(sourceHost, destHost, keypath, command string) (string, error) {
+// rsyncVanished is the exit code of rsync when a file or directory vanishes
+// between listing and transferring it. This can be expected when doing a full
+// backup while working with docker containers, for example.
+const rsyncVanished = 24
+
+// rsyncSucceeded returns whether the rsync exit code indicates success, which
+// includes rsyncVanished. The exit code itself is recorded unchanged.
+func rsyncSucceeded(exitCode int) bool {
+	return exitCode == 0 || exitCode == rsyncVanished
+}
+
+// rsyncResult describes a finished rsync invocation.
+type rsyncResult struct {
+	// Started is false if rsync could not be started (e.g. SSH failed).
+	Started  bool
+	ExitCode int
+	// Stats is nil if rsync did not print transfer totals.
+	Stats *rsyncprom.Stats
+}
+
+// rsyncSSH runs command on sourceHost (which starts rsync to destHost). The
+// output is stored in a temporary file (whose name is returned) and copied to
+// output while rsync is running. kind (backup or sync) labels the metrics.
+func rsyncSSH(ctx context.Context, kind, sourceHost, destHost, keypath, command string, output io.Writer) (string, rsyncResult, error) {
+	var res rsyncResult
 	logFile, err := os.CreateTemp("", "dornröschen-ssh-*.log")
 	if err != nil {
-		return "", err
+		return "", res, err
 	}
 	defer logFile.Close()
-	logger := log.New(logFile, "", log.LstdFlags)
+	logger := log.New(io.MultiWriter(logFile, output), "", log.LstdFlags)
 
-	var session *ssh.Session
-	defer func() {
-		if session != nil {
-			session.Close()
+	start, wait := sshCommandFor(logger, sourceHost, keypath, command)
+
+	// Parse the rsync output ourselves (WrapRsync, if used, only pushes it) to
+	// record the transfer totals in the journal and on /metrics.
+	statsr, statsw := io.Pipe()
+	parsed := make(chan *rsyncprom.Stats, 1)
+	go func() {
+		stats, err := rsyncprom.Parse(statsr)
+		if err != nil {
+			logger.Printf("parsing rsync output: %v", err)
 		}
+		io.Copy(io.Discard, statsr)
+		parsed <- stats
 	}()
-	start, wait := sshCommandFor(logger, session, sourceHost, keypath, command)
+	var (
+		rd     io.Reader
+		waited bool
+	)
+	teeStart := func(ctx context.Context, args []string) (io.Reader, error) {
+		r, err := start(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		res.Started = true
+		rd = io.TeeReader(r, statsw)
+		return rd, nil
+	}
+	res.ExitCode = 254 // overwritten unless start fails
+	exitWait := func() int {
+		waited = true
+		res.ExitCode = wait()
+		if rsyncSucceeded(res.ExitCode) {
+			// The Pushgateway exit code metric means 0 = success.
+			return 0
+		}
+		return res.ExitCode
+	}
 
-	ctx := context.Background()
-	params := rsyncprom.WrapParams{
-		Pushgateway: "https://pushgateway.monkey-turtle.ts.net",
-		Instance:    "dr@" + sourceHost + ":" + destHost,
-		Job:         "rsync",
+	if *pushgateway != "" {
+		params := rsyncprom.WrapParams{
+			Pushgateway: *pushgateway,
+			Instance:    pushgatewayInstanceFor(sourceHost, destHost),
+			Job:         *pushgatewayJob,
+		}
+		err = rsyncprom.WrapRsync(ctx, &params, nil, teeStart, exitWait)
+	} else {
+		_, err = teeStart(ctx, nil)
+	}
+	if rd != nil {
+		// Read the remaining output (WrapRsync stops reading when parsing
+		// fails), the session only finishes once all output was read.
+		io.Copy(io.Discard, rd)
+		if !waited {
+			res.ExitCode = wait()
+		}
+	}
+	statsw.Close()
+	if stats := <-parsed; stats != nil && stats.Found {
+		res.Stats = stats
 	}
-	return logFile.Name(), rsyncprom.WrapRsync(ctx, &params, nil, start, wait)
+	if res.Started {
+		updateRsyncMetrics(kind, sourceHost, destHost, res)
+	}
+	if err == nil && !rsyncSucceeded(res.ExitCode) {
+		err = fmt.Errorf("rsync exited with exit code %d", res.ExitCode)
+	}
+	return logFile.Name(), res, err
 }
 
-func sshCommand(logger *log.Logger, host, keypath, command string) error {
-	var session *ssh.Session
-	defer func() {
-		if session != nil {
-			session.Close()
-		}
-	}()
-	start, wait := sshCommandFor(logger, session, host, keypath, command)
+func sshCommand(ctx context.Context, logger *log.Logger, host, keypath, command string) error {
+	start, wait := sshCommandFor(logger, host, keypath, command)
 
-	rd, err := start(context.Background(), nil)
+	rd, err := start(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -152,3 +248,20 @@ func sshCommand(logger *log.Logger, host, keypath, command string) error {
 	}
 	return nil
 }
+
+// sshOutput runs command on host and returns its standard output. The session
+// is closed when ctx is done.
+func sshOutput(ctx context.Context, host, keypath, command string) (string, error) {
+	session, release, err := sshClients.newSession(ctx, host, keypath)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+	out, err := session.Output(command)
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	return string(out), err
+}
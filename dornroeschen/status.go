@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"sort"
+	gosync "sync"
+	"time"
+)
+
+// maxOutput is how many bytes of SSH/rsync output to keep per task.
+const maxOutput = 1 << 20
+
+// outputLog is an io.Writer which keeps the (most recent maxOutput bytes of)
+// output of a task so that it can be streamed to HTTP clients while the task
+// is running.
+type outputLog struct {
+	mu      gosync.Mutex
+	buf     []byte
+	base    int // offset of buf[0] within the entire output
+	closed  bool
+	changed chan struct{} // closed (and replaced) whenever buf changes
+}
+
+func newOutputLog() *outputLog {
+	return &outputLog{changed: make(chan struct{})}
+}
+
+func (o *outputLog) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.buf = append(o.buf, p...)
+	if over := len(o.buf) - maxOutput; over > 0 {
+		// Trim in larger chunks to not copy the buffer on every write.
+		over += maxOutput / 4
+		o.buf = append([]byte(nil), o.buf[over:]...)
+		o.base += over
+	}
+	close(o.changed)
+	o.changed = make(chan struct{})
+	return len(p), nil
+}
+
+func (o *outputLog) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	close(o.changed)
+}
+
+// readFrom returns the output starting at offset off (or the oldest output
+// still kept), the offset at which to continue reading, and a channel which is
+// closed once more output is available. The channel is nil once the task is
+// done and all output was returned.
+func (o *outputLog) readFrom(off int) ([]byte, int, <-chan struct{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if off < o.base {
+		off = o.base
+	}
+	b := append([]byte(nil), o.buf[off-o.base:]...)
+	next := o.base + len(o.buf)
+	if o.closed {
+		return b, next, nil
+	}
+	return b, next, o.changed
+}
+
+// task is the backup of a single host, or the sync of one NAS to another.
+type task struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"` // backup or sync
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Phase       string    `json:"phase"`
+	Since       time.Time `json:"since"` // when Phase was entered
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end,omitzero"`
+	Error       string    `json:"error,omitempty"`
+
+	output *outputLog
+}
+
+const (
+	phaseDone     = "done"
+	phaseFailed   = "failed"
+	phaseCanceled = "canceled"
+)
+
+// runStatus is the status of the currently running (or last) job.
+type runStatus struct {
+	Job     string    `json:"job"`
+	Running bool      `json:"running"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end,omitzero"`
+	Error   string    `json:"error,omitempty"`
+	// CancelReason is why the run was canceled (e.g. because it exceeded
+	// -run_timeout), if it was.
+	CancelReason string `json:"cancel_reason,omitempty"`
+}
+
+var (
+	statusMu gosync.Mutex
+	// tasks contains the most recent task of each kind/source/destination
+	// combination.
+	tasks   = make(map[string]*task)
+	lastRun runStatus
+	// cancelCurrent cancels the currently running job, if any.
+	cancelCurrent context.CancelCauseFunc
+)
+
+// beginTask registers a new task, replacing any previous task with the same
+// kind, source and destination.
+func beginTask(kind, source, destination, phase string) *task {
+	now := time.Now()
+	t := &task{
+		ID:          kind + "/" + source + "/" + destination,
+		Kind:        kind,
+		Source:      source,
+		Destination: destination,
+		Phase:       phase,
+		Since:       now,
+		Start:       now,
+		output:      newOutputLog(),
+	}
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if prev, ok := tasks[t.ID]; ok {
+		prev.output.close()
+	}
+	tasks[t.ID] = t
+	return t
+}
+
+func (t *task) setPhase(phase string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	t.Phase = phase
+	t.Since = time.Now()
+}
+
+// finish marks the task as done (or failed/canceled, if err is non-nil) and
+// ends its output stream.
+func (t *task) finish(ctx context.Context, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	t.Phase = phaseDone
+	if err != nil {
+		t.Phase = phaseFailed
+		if ctx.Err() != nil {
+			t.Phase = phaseCanceled
+		}
+		t.Error = err.Error()
+	}
+	t.Since = time.Now()
+	t.End = t.Since
+	t.output.close()
+}
+
+func lookupTask(id string) (*task, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	t, ok := tasks[id]
+	return t, ok
+}
+
+// status is a consistent copy of the status for display.
+type status struct {
+	Run       runStatus        `json:"run"`
+	Tasks     []task           `json:"tasks"`
+	Schedules []scheduleStatus `json:"schedules"`
+}
+
+func currentStatus() status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	st := status{
+		Run:       lastRun,
+		Schedules: currentSchedules(),
+	}
+	for _, t := range tasks {
+		st.Tasks = append(st.Tasks, *t)
+	}
+	sort.Slice(st.Tasks, func(i, j int) bool {
+		return st.Tasks[i].ID < st.Tasks[j].ID
+	})
+	return st
+}
+
+// beginRun records that job was started. cancel is called by cancelRun.
+func beginRun(job string, cancel context.CancelCauseFunc) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastRun = runStatus{
+		Job:     job,
+		Running: true,
+		Start:   time.Now(),
+	}
+	cancelCurrent = cancel
+}
+
+func finishRun(ctx context.Context, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastRun.Running = false
+	lastRun.End = time.Now()
+	if err != nil {
+		lastRun.Error = err.Error()
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		lastRun.CancelReason = cause.Error()
+	}
+	cancelCurrent = nil
+}
+
+// cancelRun cancels the currently running job. It returns false if no job is
+// running.
+func cancelRun(cause error) bool {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if cancelCurrent == nil {
+		return false
+	}
+	cancelCurrent(cause)
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/wake"
+)
+
+// restoreInventory restores the current host inventory of package wake once
+// the test finished.
+func restoreInventory(t *testing.T) {
+	t.Helper()
+	b, err := json.Marshal(struct {
+		Hosts []wake.Host `json:"hosts"`
+	}{wake.Hosts()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "restore.json")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := wake.LoadHosts(path); err != nil {
+			t.Errorf("restoring host inventory: %v", err)
+		}
+	})
+}
+
+func TestWakeConfigUsesInventory(t *testing.T) {
+	restoreInventory(t)
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	const inventory = `{"hosts": [{
+  "name": "storage4",
+  "ip": "10.11.0.4",
+  "mac": "70:85:c2:00:00:04",
+  "power": {"type": "wol"},
+  "wol": {"subnet": "10.11.0.0/24", "port": 7, "password": "01:02:03:04:05:06"}
+}]}`
+	if err := os.WriteFile(path, []byte(inventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := wake.LoadHosts(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := wakeConfig("10.11.0.4", "70:85:c2:00:00:05")
+	want := wake.Host{
+		Name:  "storage4",
+		IP:    "10.11.0.4",
+		MAC:   "70:85:c2:00:00:05", // flag takes precedence
+		Power: &wake.PowerConfig{Type: "wol"},
+		WOL: &wake.WOLConfig{
+			Subnet:   "10.11.0.0/24",
+			Port:     7,
+			Password: "01:02:03:04:05:06",
+		},
+	}
+	if !reflect.DeepEqual(cfg.Target, want) {
+		t.Errorf("wakeConfig(10.11.0.4) = %+v, want %+v", cfg.Target, want)
+	}
+	pc, err := cfg.Target.PowerController()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, ok := pc.(*wake.WOL); !ok || w.WOLConfig != *want.WOL {
+		t.Errorf("PowerController() = %#v, want WOL with %+v", pc, *want.WOL)
+	}
+
+	// Hosts which are not in the inventory use their flag values.
+	cfg = wakeConfig("10.11.0.5", "70:85:c2:00:00:06")
+	if want := (wake.Host{Name: "10.11.0.5", IP: "10.11.0.5", MAC: "70:85:c2:00:00:06"}); !reflect.DeepEqual(cfg.Target, want) {
+		t.Errorf("wakeConfig(10.11.0.5) = %+v, want %+v", cfg.Target, want)
+	}
+}
+
+func TestRestoreInventory(t *testing.T) {
+	before := wake.Hosts()
+	t.Run("load", func(t *testing.T) {
+		restoreInventory(t)
+		path := filepath.Join(t.TempDir(), "hosts.json")
+		if err := os.WriteFile(path, []byte(`{"hosts": []}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := wake.LoadHosts(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if after := wake.Hosts(); !reflect.DeepEqual(after, before) {
+		t.Errorf("host inventory not restored: got %+v, want %+v", after, before)
+	}
+}
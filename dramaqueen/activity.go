@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+)
+
+var unavailableIsBusy = flag.Bool("unavailable_is_busy",
+	true,
+	"consider activity sources which cannot be checked (e.g. because “net” fails while smbd restarts) as active, i.e. do not shut down while any source is unavailable.")
+
+const (
+	// activityInterval is how often each ActivitySource is checked.
+	activityInterval = 10 * time.Second
+	// activityTimeout bounds a single check.
+	activityTimeout = 30 * time.Second
+)
+
+// ActivitySource reports whether somebody is using the machine.
+type ActivitySource interface {
+	// Name identifies the source on the status page, e.g. samba.
+	Name() string
+	// Check returns whether there currently is activity, and details
+	// describing it (e.g. client addresses). If err is non-nil, active is
+	// only considered if it is true (e.g. one of multiple probes failed, but
+	// another one found activity).
+	Check(ctx context.Context) (active bool, details []string, err error)
+}
+
+// activities contains the most recent result of each ActivitySource, keyed by
+// name. Guarded by statusLock.
+var activities = make(map[string]*dramaqueen.Activity)
+
+// activitySources returns the sources enabled by flags.
+func activitySources() []ActivitySource {
+	var sources []ActivitySource
+	if *netCommand != "" {
+		sources = append(sources, sambaSource{})
+	}
+	if *utmpPath != "" {
+		sources = append(sources, sshSource{path: *utmpPath})
+	}
+	if *nfsdClientsDir != "" {
+		sources = append(sources, nfsSource{dir: *nfsdClientsDir})
+	}
+	if *tcpPorts != "" {
+		src, err := newTCPSource(*tcpPorts)
+		if err != nil {
+			log.Fatalf("-tcp_ports: %v", err)
+		}
+		sources = append(sources, src)
+	}
+	if *httpProbes != "" {
+		src, err := newHTTPSource(*httpProbes)
+		if err != nil {
+			log.Fatalf("-http_probes: %v", err)
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// watchActivity runs infinitely as a goroutine, periodically checking src.
+func watchActivity(src ActivitySource) {
+	for {
+		ctx, canc := context.WithTimeout(context.Background(), activityTimeout)
+		active, details, err := src.Check(ctx)
+		canc()
+		if err != nil {
+			log.Printf("[%s] %v", src.Name(), err)
+		}
+		statusLock.Lock()
+		updateActivity(activities[src.Name()], active, details, err)
+		statusLock.Unlock()
+		time.Sleep(activityInterval)
+	}
+}
+
+// updateActivity records the result of a check in a. A failed check does not
+// mean that nobody is using the machine, so unless activity was found
+// nevertheless, the source is considered unavailable, which counts as active
+// with -unavailable_is_busy. statusLock must be held.
+func updateActivity(a *dramaqueen.Activity, active bool, details []string, err error) {
+	a.Checked = time.Now()
+	a.Active = active
+	a.Details = details
+	a.Unavailable = false
+	a.Error = ""
+	if err == nil {
+		return
+	}
+	a.Errors++
+	a.Error = err.Error()
+	if !active {
+		a.Unavailable = true
+		a.Active = *unavailableIsBusy
+	}
+}
+
+// startActivitySources starts a goroutine per source.
+func startActivitySources(sources []ActivitySource) {
+	statusLock.Lock()
+	for _, src := range sources {
+		// Play it safe: assume somebody is using the machine until checked.
+		activities[src.Name()] = &dramaqueen.Activity{
+			Source: src.Name(),
+			Active: true,
+		}
+	}
+	statusLock.Unlock()
+	for _, src := range sources {
+		go watchActivity(src)
+	}
+}
+
+// activeSources returns the sorted names of the sources which found activity.
+// statusLock must be held.
+func activeSources() []string {
+	var active []string
+	for name, a := range activities {
+		if a.Active {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// currentActivity returns a copy of the activity of all sources, sorted by
+// name. statusLock must be held.
+func currentActivity() []dramaqueen.Activity {
+	result := []dramaqueen.Activity{}
+	for _, a := range activities {
+		c := *a
+		c.Details = append([]string(nil), a.Details...)
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Source < result[j].Source
+	})
+	return result
+}
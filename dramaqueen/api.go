@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+)
+
+// idleSince is when shutting down became possible, or the zero time if it is
+// currently not possible. Guarded by statusLock.
+var idleSince time.Time
+
+// sortedInhibitors returns a copy of the inhibitors, sorted by key.
+// statusLock must be held.
+func sortedInhibitors() []dramaqueen.Inhibitor {
+	result := []dramaqueen.Inhibitor{}
+	for _, inh := range inhibitors {
+		result = append(result, *inh)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// currentSessions returns the samba sessions. statusLock must be held.
+func currentSessions() dramaqueen.Sessions {
+	sessions := dramaqueen.Sessions{
+		Hosts:   []string{},
+		Clients: currentClients(),
+	}
+	if a, ok := activities[sambaSource{}.Name()]; ok {
+		sessions.Hosts = append(sessions.Hosts, a.Details...)
+		sessions.Reachable = a.Active
+	}
+	return sessions
+}
+
+// idleStatus returns whether and when the machine will be shut down.
+// statusLock must be held.
+func idleStatus(now time.Time) dramaqueen.Idle {
+	idle := dramaqueen.Idle{
+		IdleTimeoutSeconds: int64(policy.idleTimeout(now).Seconds()),
+		Restriction:        policy.restriction(now),
+		Action:             *action,
+		DryRun:             *dryRun,
+		ShuttingDown:       lastShutdown.Result == "running",
+	}
+	for _, name := range activeSources() {
+		if activities[name].Unavailable {
+			idle.BlockedBy = append(idle.BlockedBy, "unavailable "+name)
+			continue
+		}
+		idle.BlockedBy = append(idle.BlockedBy, "activity "+name)
+	}
+	for _, inh := range sortedInhibitors() {
+		idle.BlockedBy = append(idle.BlockedBy, "inhibitor "+inh.Key)
+	}
+	idle.ShutdownPossible = len(idle.BlockedBy) == 0
+	if idle.ShutdownPossible && !idleSince.IsZero() {
+		idle.IdleSince = idleSince
+		if at := policy.shutdownAt(idleSince, now); !at.IsZero() {
+			idle.ShutdownAt = at
+			idle.RemainingSeconds = max(0, int64(at.Sub(now).Seconds()))
+		}
+	}
+	return idle
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	apiErr := dramaqueen.APIError{Message: err.Error()}
+	var conflict *dramaqueen.ConflictError
+	if errors.As(err, &conflict) {
+		status = http.StatusConflict
+		apiErr.Inhibitor = &conflict.Held
+	}
+	writeJSON(w, status, apiErr)
+}
+
+// currentState returns the entire state, as served by GET /api/v1/state.
+func currentState() dramaqueen.State {
+	now := time.Now()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	pruneInhibitors(now)
+	return dramaqueen.State{
+		Sessions:   currentSessions(),
+		Activity:   currentActivity(),
+		Inhibitors: sortedInhibitors(),
+		Idle:       idleStatus(now),
+	}
+}
+
+func handleAPIState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentState())
+}
+
+func handleAPISessions(w http.ResponseWriter, r *http.Request) {
+	statusLock.Lock()
+	sessions := currentSessions()
+	statusLock.Unlock()
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func handleAPIActivity(w http.ResponseWriter, r *http.Request) {
+	statusLock.Lock()
+	activity := currentActivity()
+	statusLock.Unlock()
+	writeJSON(w, http.StatusOK, activity)
+}
+
+func handleAPIIdle(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	statusLock.Lock()
+	pruneInhibitors(now)
+	idle := idleStatus(now)
+	statusLock.Unlock()
+	writeJSON(w, http.StatusOK, idle)
+}
+
+func handleAPIInhibitors(w http.ResponseWriter, r *http.Request) {
+	statusLock.Lock()
+	pruneInhibitors(time.Now())
+	result := sortedInhibitors()
+	statusLock.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+func handleAPIInhibitor(w http.ResponseWriter, r *http.Request) {
+	statusLock.Lock()
+	pruneInhibitors(time.Now())
+	var inh dramaqueen.Inhibitor
+	held, ok := inhibitors[r.PathValue("key")]
+	if ok {
+		inh = *held
+	}
+	statusLock.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errNoSuchInhibitor)
+		return
+	}
+	writeJSON(w, http.StatusOK, inh)
+}
+
+// handleAPIInhibit acquires or renews an inhibitor. It responds with HTTP 201
+// (Created) for new inhibitors, HTTP 200 for renewed inhibitors and HTTP 409
+// (Conflict) if the inhibitor is held by a different owner.
+func handleAPIInhibit(w http.ResponseWriter, r *http.Request) {
+	var req dramaqueen.InhibitRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Key == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("key must not be empty"))
+		return
+	}
+	ttl, err := parseTTL(req.TTL)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	inh, created, err := inhibit(req.Key, req.Owner, req.Reason, ttl)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/api/v1/inhibitors/"+url.PathEscape(inh.Key))
+	}
+	writeJSON(w, status, inh)
+}
+
+// handleAPIRelease releases an inhibitor held by the owner query parameter.
+func handleAPIRelease(w http.ResponseWriter, r *http.Request) {
+	_, err := release(r.PathValue("key"), r.FormValue("owner"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoSuchInhibitor) {
+			status = http.StatusNotFound
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerAPIHandlers registers the JSON API, see package internal/dramaqueen
+// for a client.
+func registerAPIHandlers() {
+	http.HandleFunc("GET /api/v1/state", handleAPIState)
+	http.HandleFunc("GET /api/v1/sessions", handleAPISessions)
+	http.HandleFunc("GET /api/v1/activity", handleAPIActivity)
+	http.HandleFunc("GET /api/v1/idle", handleAPIIdle)
+	http.HandleFunc("GET /api/v1/inhibitors", handleAPIInhibitors)
+	http.HandleFunc("POST /api/v1/inhibitors", handleAPIInhibit)
+	http.HandleFunc("GET /api/v1/inhibitors/{key}", handleAPIInhibitor)
+	http.HandleFunc("DELETE /api/v1/inhibitors/{key}", handleAPIRelease)
+}
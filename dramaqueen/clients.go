@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+	"github.com/stapelberg/zkj-nas-tools/internal/timestamped"
+)
+
+var (
+	clientUpDelay = flag.Duration("client_up_delay",
+		30*time.Second,
+		"how long a samba client must respond to pings before it is considered active, so that e.g. a laptop waking up briefly does not reset the idle timer.")
+	clientDownDelay = flag.Duration("client_down_delay",
+		1*time.Minute,
+		"how long a samba client must not respond to pings before it is considered inactive, so that a single dropped ping does not start the idle timer.")
+)
+
+// client is a host with samba sessions.
+type client struct {
+	// reachable is the most recent ping result.
+	reachable timestamped.Bool
+	// active follows reachable once it did not change for -client_up_delay
+	// or -client_down_delay, respectively.
+	active   timestamped.Bool
+	lastSeen time.Time
+	// rtt is the round trip time of the most recent ping reply.
+	rtt time.Duration
+}
+
+func (c *client) update(reachable bool, rtt time.Duration) {
+	c.reachable.Set(reachable)
+	if reachable {
+		c.lastSeen = time.Now()
+		c.rtt = rtt
+	}
+	delay := *clientDownDelay
+	if reachable {
+		delay = *clientUpDelay
+	}
+	if c.active.Value() != reachable && time.Since(c.reachable.LastChange()) >= delay {
+		c.active.Set(reachable)
+	}
+}
+
+// clients contains the hosts with samba sessions, keyed by host. Guarded by
+// statusLock.
+var clients = make(map[string]*client)
+
+// updateClients records the ping results of hosts (rtts contains the hosts
+// which replied), forgets hosts without sessions and returns whether any
+// client is active. statusLock must be held.
+func updateClients(hosts []string, rtts map[string]time.Duration) bool {
+	current := make(map[string]bool)
+	for _, host := range hosts {
+		current[host] = true
+	}
+	for host := range clients {
+		if !current[host] {
+			delete(clients, host)
+		}
+	}
+	active := false
+	for _, host := range hosts {
+		c, ok := clients[host]
+		if !ok {
+			c = &client{}
+			c.active.Set(false)
+			clients[host] = c
+		}
+		rtt, reachable := rtts[host]
+		c.update(reachable, rtt)
+		if c.active.Value() {
+			active = true
+		}
+	}
+	return active
+}
+
+// currentClients returns the clients, sorted by host. statusLock must be held.
+func currentClients() []dramaqueen.SambaClient {
+	result := []dramaqueen.SambaClient{}
+	for host, c := range clients {
+		result = append(result, dramaqueen.SambaClient{
+			Host:      host,
+			Reachable: c.reachable.Value(),
+			Active:    c.active.Value(),
+			Since:     c.active.LastChange(),
+			LastSeen:  c.lastSeen,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
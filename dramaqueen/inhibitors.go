@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+)
+
+var defaultInhibitorTTL = flag.Duration("default_inhibitor_ttl",
+	12*time.Hour,
+	"TTL of inhibitors requested without a ttl parameter, so that a crashed client does not keep the machine up forever (0 = never expire).")
+
+var errNoSuchInhibitor = errors.New("no such inhibitor")
+
+// pruneInhibitors removes the inhibitors which expired at now. statusLock
+// must be held.
+func pruneInhibitors(now time.Time) {
+	for key, inh := range inhibitors {
+		if !inh.Expired(now) {
+			continue
+		}
+		log.Printf("inhibitor %q of %q (reason: %q) expired", key, inh.Owner, inh.Reason)
+		delete(inhibitors, key)
+		notifyStateChanged()
+	}
+}
+
+// parseTTL parses the ttl of an inhibit request, empty meaning
+// -default_inhibitor_ttl.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return *defaultInhibitorTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("invalid ttl (expected a positive duration, e.g. 30m)")
+	}
+	return ttl, nil
+}
+
+// inhibit acquires the inhibitor key for owner, or renews it if owner already
+// holds it. Inhibitors held by a different owner result in a
+// *dramaqueen.ConflictError, so that clients notice when e.g. a previous run
+// overran.
+func inhibit(key, owner, reason string, ttl time.Duration) (_ dramaqueen.Inhibitor, created bool, _ error) {
+	now := time.Now()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	pruneInhibitors(now)
+	inh, ok := inhibitors[key]
+	if ok && inh.Owner != owner {
+		return dramaqueen.Inhibitor{}, false, &dramaqueen.ConflictError{Held: *inh}
+	}
+	if !ok {
+		inh = &dramaqueen.Inhibitor{
+			Key:   key,
+			Owner: owner,
+			Since: now,
+		}
+		inhibitors[key] = inh
+		log.Printf("inhibitor %q acquired by %q (reason: %q, ttl: %v)", key, owner, reason, ttl)
+	}
+	inh.Reason = reason
+	inh.Expires = time.Time{}
+	if ttl > 0 {
+		inh.Expires = now.Add(ttl)
+	}
+	notifyStateChanged()
+	return *inh, !ok, nil
+}
+
+// release releases the inhibitor key, which must be held by owner.
+func release(key, owner string) (dramaqueen.Inhibitor, error) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	pruneInhibitors(time.Now())
+	inh, ok := inhibitors[key]
+	if !ok {
+		return dramaqueen.Inhibitor{}, errNoSuchInhibitor
+	}
+	if inh.Owner != owner {
+		return dramaqueen.Inhibitor{}, &dramaqueen.ConflictError{Held: *inh}
+	}
+	delete(inhibitors, key)
+	log.Printf("inhibitor %q released by %q", key, owner)
+	notifyStateChanged()
+	return *inh, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing JSON response: %v", err)
+	}
+}
+
+// inhibitorKey returns the inhibitor parameter of r. The key parameter is
+// accepted as well, as older versions of dramaqueen (and their clients) used
+// it despite documenting inhibitor.
+func inhibitorKey(r *http.Request) string {
+	if key := r.FormValue("inhibitor"); key != "" {
+		return key
+	}
+	return r.FormValue("key")
+}
+
+// legacyError writes err as the response to /inhibit or /release.
+func legacyError(w http.ResponseWriter, err error) {
+	var conflict *dramaqueen.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		writeJSON(w, http.StatusConflict, conflict.Held)
+	case errors.Is(err, errNoSuchInhibitor):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleInhibit serves POST /inhibit?inhibitor=<key>&owner=…&reason=…&ttl=…
+func handleInhibit(w http.ResponseWriter, r *http.Request) {
+	key := inhibitorKey(r)
+	if key == "" {
+		http.Error(w, "inhibitor parameter missing", http.StatusBadRequest)
+		return
+	}
+	ttl, err := parseTTL(r.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inh, _, err := inhibit(key, r.FormValue("owner"), r.FormValue("reason"), ttl)
+	if err != nil {
+		legacyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inh)
+}
+
+// handleRelease serves POST /release?inhibitor=<key>&owner=…
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	inh, err := release(inhibitorKey(r), r.FormValue("owner"))
+	if err != nil {
+		legacyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inh)
+}
@@ -1,26 +1,61 @@
 // If nobody pays any attention to my samba server, I might as well power off!
 //
 // Parses the output of “net status sessions parseable” and pings all of the
-// machines that are listed in the output. If none of the machines responds,
-// dramaqueen might shut off the machine after a brief timeout.
+// machines that are listed in the output. If none of the machines responds
+// (for -client_down_delay; machines must respond for -client_up_delay to count),
+// dramaqueen might shut off the machine after a brief timeout (or suspend it,
+// see -action and -hooks_dir).
 //
-// The automatic shutdown might be restricted to certain times of the day or
-// inhibited entirely by calling /inhibit?inhibitor=<key>, where each <key>
-// identifies the requesting program. To undo, call /release?inhibitor=<key>,
+// Besides samba, further activity sources keep the machine up: logins (see
+// -utmp_path), NFS clients (-nfsd_clients_dir), established TCP connections
+// (-tcp_ports) and HTTP probes (-http_probes).
+//
+// The automatic shutdown can be restricted to certain times of the day (see
+// -shutdown_windows), wait for a different idle timeout depending on the time
+// of day (-idle_timeouts) or after booting (-boot_grace), or only be logged
+// (-dry_run). It can be inhibited entirely by POSTing to
+// /inhibit?inhibitor=<key>, where each <key> identifies the requesting
+// program. To undo, POST to /release?inhibitor=<key>,
 // to inspect, check /
+//
+// Inhibitors are held by an owner (owner parameter) and expire after a TTL
+// (ttl parameter, default -default_inhibitor_ttl) unless renewed by inhibiting
+// again.
+//
+// The same functionality is available as a JSON API (see package
+// internal/dramaqueen for a client):
+//
+//	GET    /api/v1/state             sessions, activity, inhibitors and idle countdown
+//	GET    /api/v1/sessions          samba sessions and whether they are reachable
+//	GET    /api/v1/activity          activity of each source (samba, ssh, nfs, …)
+//	GET    /api/v1/idle              whether and when the machine shuts down
+//	GET    /api/v1/inhibitors        all inhibitors
+//	POST   /api/v1/inhibitors        acquire/renew, body {"key", "owner", "reason", "ttl"}
+//	GET    /api/v1/inhibitors/<key>  one inhibitor
+//	DELETE /api/v1/inhibitors/<key>?owner=<owner>
+//
+// With -mqtt_broker, the state is also published via MQTT, and inhibitors can
+// be acquired and released via MQTT (see -mqtt_topic).
+//
+// -notify_before the shutdown, users are notified (see -notify_webhook,
+// -notify_samba_command and -mqtt_broker) with a link to /postpone, which
+// acquires a time-limited inhibitor.
+//
+// Prometheus metrics are exported at /metrics.
 package main
 
 import (
 	"flag"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/stapelberg/zkj-nas-tools/ping"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
 )
 
 var (
@@ -29,146 +64,169 @@ var (
 		"“net” command, called as “net status sessions parseable”.")
 	idleDuration = flag.Duration("idle",
 		10*time.Minute,
-		"time to wait before actually shutting down.")
+		"time to wait before actually shutting down, unless overridden by -idle_timeouts.")
 	listenAddress = flag.String("listen_address",
 		":4414",
 		"host:port to listen on (http).")
+	unprivilegedPing = flag.Bool("unprivileged_ping",
+		false,
+		"use unprivileged ICMP sockets (see net.ipv4.ping_group_range) instead of raw sockets, which require CAP_NET_RAW.")
 
-	// Play it safe: assume somebody is using the samba server currently.
-	reachableUsers bool = true
-	inhibitors          = make(map[string]time.Time)
-	hosts          []string
-	statusLock     sync.Mutex
+	inhibitors = make(map[string]*dramaqueen.Inhibitor)
+	statusLock sync.Mutex
 )
 
-// NB: Even though it says hostname, on my machine this is an IP address.
-func getSessionHostnames() []string {
-	// from samba/2:3.6.16-1/source3/utils/net_status.c:
-	// if (*parseable) {
-	// 		d_printf("%s\\%s\\%s\\%s\\%s\n",
-	// 			 procid_str_static(&session->pid),
-	// 			 uidtoname(session->uid),
-	// 			 gidtoname(session->gid),
-	// 			 session->remote_machine, session->hostname);
-	// 	}
-
-	cmd := exec.Command(*netCommand, "status", "sessions", "parseable")
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	hostnames := []string{}
-	for _, line := range strings.Split(string(out), "\n") {
-		parts := strings.Split(line, "\\")
-		if len(parts) < 4 {
-			continue
-		}
-		hostnames = append(hostnames, parts[4])
-	}
-
-	return hostnames
-}
-
 // Checks periodically whether a shutdown is appropriate.
 func checkShutdown() {
-	possibleSince := time.Now()
+	notifiers := notifiers()
+	statusLock.Lock()
+	idleSince = time.Now()
+	statusLock.Unlock()
 	for {
 		time.Sleep(1 * time.Second)
 
 		statusLock.Lock()
-		shutdownPossible := !reachableUsers && len(inhibitors) == 0
+		pruneInhibitors(time.Now())
+		possible := shutdownPossible()
+		if !possible {
+			idleSince = time.Time{}
+		} else if idleSince.IsZero() {
+			idleSince = time.Now()
+		}
+		possibleSince := idleSince
+		if possible {
+			maybeNotify(notifiers)
+		}
 		statusLock.Unlock()
 
-		if !shutdownPossible {
-			possibleSince = time.Now()
+		if !possible {
 			continue
 		}
 
-		if time.Since(possibleSince) <= *idleDuration {
+		if !policy.ready(possibleSince, time.Now()) {
 			continue
 		}
 
-		cmd := exec.Command("systemctl", "poweroff")
-		err := cmd.Run()
-		if err != nil {
-			log.Fatalf("%v: %v", cmd.Args, err)
-		}
-
-		time.Sleep(60)
-		log.Fatal("This program still lives 60s after triggering a shutdown.")
+		shutdownAndRecord()
 	}
 }
 
-// Runs infinitely as a goroutine, periodically pinging samba users.
-func pingUsers() {
-	if *netCommand == "" {
-		statusLock.Lock()
-		defer statusLock.Unlock()
-		reachableUsers = false
-		return
+func main() {
+	flag.Parse()
+
+	if err := validateAction(); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if policy, err = policyFromFlags(); err != nil {
+		log.Fatal(err)
 	}
-	for {
-		statusLock.Lock()
-		hosts = getSessionHostnames()
-		statusLock.Unlock()
 
-		// This default will lead to a shutdown in case the machine gets booted
-		// and nobody starts using it within 10 minutes, which is intentional.
-		// The machine should only be booted when usage is imminent.
-		reachable := false
-		if len(hosts) > 0 {
-			result := make(chan *time.Duration)
-			for _, host := range hosts {
-				go ping.Ping(host, 5*time.Second, result)
+	if *mqttBroker != "" {
+		mqttClient = newMQTTClient()
+		go func() {
+			if err := runMQTT(mqttClient); err != nil {
+				log.Print(err)
 			}
-			reachable = <-result != nil
-		}
-		statusLock.Lock()
-		reachableUsers = reachable
-		statusLock.Unlock()
-		time.Sleep(10 * time.Second)
+		}()
 	}
-}
-
-func main() {
-	flag.Parse()
 
-	go pingUsers()
+	startActivitySources(activitySources())
 	go checkShutdown()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		statusLock.Lock()
 		fmt.Fprintf(w, `<html><head><meta charset="utf8"></head><body>`)
-		fmt.Fprintf(w, "hosts = %v<br>\n", hosts)
-		fmt.Fprintf(w, "reachable = %v", reachableUsers)
+		fmt.Fprintf(w, "action = %s<br>\n", *action)
+		if !lastShutdown.Start.IsZero() {
+			fmt.Fprintf(w, "last %s at %v: %s<br>\n",
+				lastShutdown.Action, lastShutdown.Start.Format(time.DateTime), html.EscapeString(lastShutdown.Result))
+		}
+		now := time.Now()
+		idle := idleStatus(now)
+		fmt.Fprintf(w, "<h2>Shutdown policy</h2><ul>")
+		for _, line := range policy.describe(now) {
+			fmt.Fprintf(w, "<li>%s</li>", html.EscapeString(line))
+		}
+		if idle.Restriction != "" {
+			fmt.Fprintf(w, "<li>currently not allowed: %s</li>", html.EscapeString(idle.Restriction))
+		}
+		if !idle.ShutdownPossible {
+			fmt.Fprintf(w, "<li>blocked by %s</li>", html.EscapeString(strings.Join(idle.BlockedBy, ", ")))
+		} else if !idle.ShutdownAt.IsZero() {
+			fmt.Fprintf(w, "<li>idle since %v, %s at %v</li>",
+				idle.IdleSince.Format(time.DateTime), *action, idle.ShutdownAt.Format(time.DateTime))
+		}
+		fmt.Fprintf(w, "</ul>")
+		fmt.Fprintf(w, "<h2>Activity</h2><ul>")
+		for _, a := range currentActivity() {
+			state := "idle"
+			if a.Active {
+				state = "active"
+			}
+			if a.Unavailable {
+				state = "unavailable"
+			}
+			fmt.Fprintf(w, `<li>%s: %s`, a.Source, state)
+			if len(a.Details) > 0 {
+				fmt.Fprintf(w, ` (%s)`, html.EscapeString(strings.Join(a.Details, ", ")))
+			}
+			if !a.Checked.IsZero() {
+				fmt.Fprintf(w, `, checked %v`, a.Checked.Format(time.DateTime))
+			}
+			if a.Error != "" {
+				fmt.Fprintf(w, `, error: %s`, html.EscapeString(a.Error))
+			}
+			if a.Errors > 0 {
+				fmt.Fprintf(w, `, %d failed checks`, a.Errors)
+			}
+			fmt.Fprintf(w, "</li>")
+		}
+		fmt.Fprintf(w, "</ul>")
+		fmt.Fprintf(w, "<h2>Samba clients</h2><ul>")
+		for _, c := range currentClients() {
+			state := "inactive"
+			if c.Active {
+				state = "active"
+			}
+			fmt.Fprintf(w, `<li>%s: %s since %v`, html.EscapeString(c.Host), state, c.Since.Format(time.DateTime))
+			if c.Reachable != c.Active {
+				fmt.Fprintf(w, ` (reachable = %v)`, c.Reachable)
+			}
+			lastSeen := "never"
+			if !c.LastSeen.IsZero() {
+				lastSeen = c.LastSeen.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, `, last seen %s</li>`, lastSeen)
+		}
+		fmt.Fprintf(w, "</ul>")
 		fmt.Fprintf(w, "<h2>Inhibitors</h2><ul>")
-		for key, since := range inhibitors {
-			fmt.Fprintf(w, `<li>inhibitor "%s" since %v</li>`, key, since)
+		for key, inh := range inhibitors {
+			fmt.Fprintf(w, `<li>inhibitor "%s" held by "%s" since %v`,
+				html.EscapeString(key), html.EscapeString(inh.Owner), inh.Since.Format(time.DateTime))
+			if inh.Reason != "" {
+				fmt.Fprintf(w, ` (%s)`, html.EscapeString(inh.Reason))
+			}
+			if !inh.Expires.IsZero() {
+				fmt.Fprintf(w, `, expires %v`, inh.Expires.Format(time.DateTime))
+			}
+			fmt.Fprintf(w, "</li>")
 		}
 		fmt.Fprintf(w, "</ul>")
-		statusLock.Unlock()
-	})
-
-	http.HandleFunc("/inhibit", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			return
+		fmt.Fprintf(w, `<form method="post" action="/postpone">postpone by `)
+		for _, d := range postponeDurations {
+			fmt.Fprintf(w, `<button name="duration" value="%v">%v</button> `, d, d)
 		}
-		key := r.FormValue("key")
-		statusLock.Lock()
-		inhibitors[key] = time.Now()
+		fmt.Fprintf(w, `</form>`)
 		statusLock.Unlock()
 	})
 
-	http.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			return
-		}
-		key := r.FormValue("key")
-		statusLock.Lock()
-		delete(inhibitors, key)
-		statusLock.Unlock()
-	})
+	http.HandleFunc("POST /inhibit", handleInhibit)
+	http.HandleFunc("POST /release", handleRelease)
+	http.HandleFunc("GET /postpone", handlePostponePage)
+	http.HandleFunc("POST /postpone", handlePostpone)
+	registerAPIHandlers()
+	http.Handle("/metrics", promhttp.Handler())
 
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
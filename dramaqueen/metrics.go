@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var shutdowns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "shutdowns_total",
+	Help: "Shutdown attempts by action and result (done, canceled, failed or dry_run)",
+}, []string{"action", "result"})
+
+// shutdownResult returns the result label of a shutdown attempt.
+func shutdownResult(err error) string {
+	switch {
+	case err == nil:
+		return "done"
+	case errors.Is(err, errShutdownCanceled):
+		return "canceled"
+	case errors.Is(err, errDryRun):
+		return "dry_run"
+	default:
+		return "failed"
+	}
+}
+
+var (
+	sambaSessionsDesc = prometheus.NewDesc(
+		"samba_sessions",
+		"Number of hosts with samba sessions",
+		nil, nil)
+	sambaClientsReachableDesc = prometheus.NewDesc(
+		"samba_clients_reachable",
+		"Number of hosts with samba sessions which responded to the most recent ping",
+		nil, nil)
+	sambaClientRTTDesc = prometheus.NewDesc(
+		"samba_client_rtt_seconds",
+		"Round trip time of the most recent ping reply of a reachable samba client",
+		[]string{"host"}, nil)
+	inhibitorsDesc = prometheus.NewDesc(
+		"inhibitors",
+		"Number of inhibitors",
+		nil, nil)
+	inhibitorAgeDesc = prometheus.NewDesc(
+		"inhibitor_age_seconds",
+		"Time since an inhibitor was acquired",
+		[]string{"key", "owner"}, nil)
+	shutdownPossibleDesc = prometheus.NewDesc(
+		"shutdown_possible",
+		"Whether there is neither activity nor an inhibitor (1) or not (0)",
+		nil, nil)
+	shutdownRemainingDesc = prometheus.NewDesc(
+		"shutdown_remaining_seconds",
+		"Time until the planned shutdown (only present while shutdown is possible)",
+		nil, nil)
+)
+
+// stateCollector exports the current state when scraped, as most of it (e.g.
+// the inhibitor age) changes continuously.
+type stateCollector struct{}
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sambaSessionsDesc
+	ch <- sambaClientsReachableDesc
+	ch <- sambaClientRTTDesc
+	ch <- inhibitorsDesc
+	ch <- inhibitorAgeDesc
+	ch <- shutdownPossibleDesc
+	ch <- shutdownRemainingDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	gauge := func(desc *prometheus.Desc, val float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labels...)
+	}
+
+	gauge(sambaSessionsDesc, float64(len(clients)))
+	reachable := 0
+	for host, c := range clients {
+		if !c.reachable.Value() {
+			continue
+		}
+		reachable++
+		gauge(sambaClientRTTDesc, c.rtt.Seconds(), host)
+	}
+	gauge(sambaClientsReachableDesc, float64(reachable))
+
+	gauge(inhibitorsDesc, float64(len(inhibitors)))
+	for key, inh := range inhibitors {
+		gauge(inhibitorAgeDesc, now.Sub(inh.Since).Seconds(), key, inh.Owner)
+	}
+
+	idle := idleStatus(now)
+	possible := 0.0
+	if idle.ShutdownPossible {
+		possible = 1
+	}
+	gauge(shutdownPossibleDesc, possible)
+	if !idle.ShutdownAt.IsZero() {
+		gauge(shutdownRemainingDesc, float64(idle.RemainingSeconds))
+	}
+}
+
+func init() {
+	prometheus.MustRegister(shutdowns)
+	prometheus.MustRegister(stateCollector{})
+}
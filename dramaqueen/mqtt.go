@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+)
+
+var (
+	mqttBroker = flag.String("mqtt_broker",
+		"",
+		"MQTT broker address for github.com/eclipse/paho.mqtt.golang, e.g. tcp://mqtt.lan:1883. Empty disables MQTT.")
+	mqttTopic = flag.String("mqtt_topic",
+		"",
+		"MQTT topic under which to publish the state (<topic>/state, retained) and availability (<topic>/online) and to receive commands (<topic>/cmd/inhibit and <topic>/cmd/release). Shutdown notices are published to <topic>/notice. Defaults to github.com/stapelberg/zkj-nas-tools/dramaqueen/<hostname>.")
+)
+
+// mqttClient is nil unless -mqtt_broker is set. It is set before any
+// goroutines are started.
+var mqttClient mqtt.Client
+
+// stateChanged triggers publishing the state via MQTT before the next periodic
+// update.
+var stateChanged = make(chan struct{}, 1)
+
+// notifyStateChanged is called when inhibitors are acquired or released, or
+// the machine is about to shut down. It does not block.
+func notifyStateChanged() {
+	select {
+	case stateChanged <- struct{}{}:
+	default:
+	}
+}
+
+func mqttTopicPrefix() string {
+	if *mqttTopic != "" {
+		return *mqttTopic
+	}
+	return "github.com/stapelberg/zkj-nas-tools/dramaqueen/" + hostname()
+}
+
+func publishState(c mqtt.Client, prefix string) {
+	if !c.IsConnectionOpen() {
+		return
+	}
+	b, err := json.Marshal(currentState())
+	if err != nil {
+		log.Printf("mqtt: %v", err)
+		return
+	}
+	c.Publish(path.Join(prefix, "state"), 0 /* qos */, true /* retained */, b)
+}
+
+// publishStates publishes the state whenever it changes, and otherwise every
+// activityInterval (activity and the shutdown countdown change continuously).
+func publishStates(c mqtt.Client, prefix string) {
+	for {
+		publishState(c, prefix)
+		select {
+		case <-stateChanged:
+		case <-time.After(activityInterval):
+		}
+	}
+}
+
+// handleCommand handles <topic>/cmd/inhibit and <topic>/cmd/release, whose
+// payload is a dramaqueen.InhibitRequest (of which release only uses key and
+// owner).
+func handleCommand(_ mqtt.Client, m mqtt.Message) {
+	log.Printf("mqtt command: %s: %s", m.Topic(), m.Payload())
+	var req dramaqueen.InhibitRequest
+	if err := json.Unmarshal(m.Payload(), &req); err != nil {
+		log.Printf("mqtt: %s: %v", m.Topic(), err)
+		return
+	}
+	if req.Key == "" {
+		log.Printf("mqtt: %s: key must not be empty", m.Topic())
+		return
+	}
+	switch path.Base(m.Topic()) {
+	case "inhibit":
+		ttl, err := parseTTL(req.TTL)
+		if err != nil {
+			log.Printf("mqtt: %s: %v", m.Topic(), err)
+			return
+		}
+		if _, _, err := inhibit(req.Key, req.Owner, req.Reason, ttl); err != nil {
+			log.Printf("mqtt: %s: %v", m.Topic(), err)
+		}
+	case "release":
+		if _, err := release(req.Key, req.Owner); err != nil {
+			log.Printf("mqtt: %s: %v", m.Topic(), err)
+		}
+	default:
+		log.Printf("mqtt: %s: unknown command", m.Topic())
+	}
+}
+
+func newMQTTClient() mqtt.Client {
+	prefix := mqttTopicPrefix()
+	opts := mqtt.NewClientOptions().AddBroker(*mqttBroker)
+	clientID := "https://github.com/stapelberg/zkj-nas-tools/dramaqueen"
+	if hostname, err := os.Hostname(); err == nil {
+		clientID += "@" + hostname
+	}
+	opts.SetClientID(clientID)
+	opts.SetConnectRetry(true)
+	opts.SetWill(path.Join(prefix, "online"), "false", 0 /* qos */, true /* retained */)
+	opts.OnConnect = func(c mqtt.Client) {
+		c.Publish(path.Join(prefix, "online"), 0 /* qos */, true /* retained */, "true")
+		const qosAtMostOnce = 0
+		topic := path.Join(prefix, "cmd", "+")
+		log.Printf("Subscribing to %s", topic)
+		if token := c.Subscribe(topic, qosAtMostOnce, handleCommand); token.Wait() && token.Error() != nil {
+			log.Printf("subscription failed: %v", token.Error())
+		}
+		notifyStateChanged()
+	}
+	return mqtt.NewClient(opts)
+}
+
+func runMQTT(c mqtt.Client) error {
+	go publishStates(c, mqttTopicPrefix())
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("MQTT connection failed: %v", token.Error())
+	}
+	return nil
+}
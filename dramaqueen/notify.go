@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	notifyBefore = flag.Duration("notify_before",
+		5*time.Minute,
+		"how long before shutting down to notify users (see -notify_webhook, -notify_samba_command and -mqtt_broker). 0 disables notifications.")
+	notifyWebhook = flag.String("notify_webhook",
+		"",
+		"URL to POST a JSON notice to before shutting down.")
+	notifySambaCommand = flag.String("notify_samba_command",
+		"",
+		"command to notify each samba client before shutting down, e.g. “smbclient -N -M {host}”. {host} is replaced by the client, the message is passed on stdin.")
+	externalURL = flag.String("external_url",
+		"",
+		"URL under which users reach dramaqueen, used for the postpone link in notices. Defaults to http://<hostname><-listen_address port>.")
+	maxPostpone = flag.Duration("max_postpone",
+		12*time.Hour,
+		"maximum duration by which users can postpone the shutdown via /postpone.")
+)
+
+// notice is sent to users before the machine shuts down.
+type notice struct {
+	Host        string    `json:"host"`
+	Action      string    `json:"action"`
+	ShutdownAt  time.Time `json:"shutdown_at"`
+	PostponeURL string    `json:"postpone_url"`
+	Message     string    `json:"message"`
+}
+
+// Notifier delivers notices through a channel like a webhook or MQTT.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n notice) error
+}
+
+// notifiers returns the notifiers enabled by flags.
+func notifiers() []Notifier {
+	var result []Notifier
+	if *notifyWebhook != "" {
+		result = append(result, webhookNotifier{url: *notifyWebhook})
+	}
+	if *mqttBroker != "" {
+		result = append(result, mqttNotifier{})
+	}
+	if *notifySambaCommand != "" {
+		result = append(result, sambaNotifier{command: strings.Fields(*notifySambaCommand)})
+	}
+	return result
+}
+
+// notifiedFor is the idleSince of the idle period for which notices were
+// sent, so that they are sent only once. Guarded by statusLock.
+var notifiedFor time.Time
+
+// maybeNotify sends notices (in the background) if the machine will shut down
+// within -notify_before. statusLock must be held.
+func maybeNotify(notifiers []Notifier) {
+	if *notifyBefore <= 0 || len(notifiers) == 0 || idleSince.IsZero() || notifiedFor.Equal(idleSince) {
+		return
+	}
+	shutdownAt := policy.shutdownAt(idleSince, time.Now())
+	if shutdownAt.IsZero() || time.Until(shutdownAt) > *notifyBefore {
+		return
+	}
+	notifiedFor = idleSince
+	n := newNotice(shutdownAt)
+	go sendNotices(notifiers, n)
+}
+
+func hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func postponeURL() string {
+	if *externalURL != "" {
+		return strings.TrimSuffix(*externalURL, "/") + "/postpone"
+	}
+	_, port, _ := net.SplitHostPort(*listenAddress)
+	return "http://" + net.JoinHostPort(hostname(), port) + "/postpone"
+}
+
+func newNotice(shutdownAt time.Time) notice {
+	n := notice{
+		Host:        hostname(),
+		Action:      *action,
+		ShutdownAt:  shutdownAt,
+		PostponeURL: postponeURL(),
+	}
+	n.Message = fmt.Sprintf("%s will shut down (-action=%s) at %s (in %v) because nobody seems to be using it. To postpone, open %s",
+		n.Host, n.Action, shutdownAt.Format("15:04"), time.Until(shutdownAt).Round(time.Second), n.PostponeURL)
+	return n
+}
+
+func sendNotices(notifiers []Notifier, n notice) {
+	ctx, canc := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer canc()
+	log.Printf("notifying users: %s", n.Message)
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			log.Printf("[notify %s] %v", notifier.Name(), err)
+		}
+	}
+}
+
+// webhookNotifier POSTs the notice as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (webhookNotifier) Name() string { return "webhook" }
+
+func (w webhookNotifier) Notify(ctx context.Context, n notice) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// mqttNotifier publishes the notice to <-mqtt_topic>/notice.
+type mqttNotifier struct{}
+
+func (mqttNotifier) Name() string { return "mqtt" }
+
+func (mqttNotifier) Notify(ctx context.Context, n notice) error {
+	if mqttClient == nil || !mqttClient.IsConnectionOpen() {
+		return errors.New("not connected")
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	token := mqttClient.Publish(path.Join(mqttTopicPrefix(), "notice"), 0 /* qos */, false /* retained */, b)
+	token.Wait()
+	return token.Error()
+}
+
+// sambaNotifier runs a command (e.g. smbclient -M) for each host with a samba
+// session (hosts which do not respond to pings might still be in use, e.g. when
+// their firewall drops ICMP).
+type sambaNotifier struct {
+	command []string
+}
+
+func (sambaNotifier) Name() string { return "samba" }
+
+func (s sambaNotifier) Notify(ctx context.Context, n notice) error {
+	statusLock.Lock()
+	sessions := currentSessions()
+	statusLock.Unlock()
+	var errs []error
+	for _, host := range sessions.Hosts {
+		args := make([]string, len(s.command))
+		for i, arg := range s.command {
+			args[i] = strings.ReplaceAll(arg, "{host}", host)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(n.Message)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v: %s", cmd.Args, err, bytes.TrimSpace(out)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// postponeKey is the inhibitor acquired by /postpone.
+const postponeKey = "postpone"
+
+var postponeDurations = []time.Duration{30 * time.Minute, 1 * time.Hour, 4 * time.Hour}
+
+// handlePostponePage serves GET /postpone, the target of the link in notices.
+// It only shows buttons, as link previews must not postpone the shutdown.
+func handlePostponePage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, `<html><head><meta charset="utf8"><title>Postpone %s</title></head><body>`, hostname())
+	fmt.Fprintf(w, `<form method="post" action="/postpone">Postpone %s of %s by `, *action, hostname())
+	for _, d := range postponeDurations {
+		fmt.Fprintf(w, `<button name="duration" value="%v">%v</button> `, d, d)
+	}
+	fmt.Fprintf(w, `</form>`)
+}
+
+// handlePostpone serves POST /postpone?duration=…, which acquires (or renews)
+// a time-limited inhibitor.
+func handlePostpone(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || d <= 0 {
+		http.Error(w, "invalid duration parameter", http.StatusBadRequest)
+		return
+	}
+	d = min(d, *maxPostpone)
+	if _, _, err := inhibit(postponeKey, postponeKey, "postponed via HTTP by "+r.RemoteAddr, d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
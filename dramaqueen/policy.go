@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	shutdownWindows = flag.String("shutdown_windows",
+		"",
+		"comma-separated list of [days ]HH:MM-HH:MM windows (local time) during which shutting down is allowed, e.g. “mon-fri 22:00-07:00,sat-sun 00:00-24:00”. days is a day (mon) or a range of days (mon-fri) on which the window starts, default every day. If the end is not after the start, the window extends into the next day. Empty allows shutting down at any time.")
+	idleTimeouts = flag.String("idle_timeouts",
+		"",
+		"comma-separated list of [days ]HH:MM-HH:MM=duration entries (see -shutdown_windows) overriding -idle during the specified windows, e.g. “22:00-07:00=5m,sat-sun 00:00-24:00=1h”. The first matching entry applies.")
+	bootGrace = flag.Duration("boot_grace",
+		0,
+		"never shut down within this duration after booting, e.g. to give users time to connect after powering on the machine.")
+	dryRun = flag.Bool("dry_run",
+		false,
+		"only log what would be done instead of running hooks and the action.")
+)
+
+// policy decides when the machine may shut down once it is idle. It is set in
+// main and not modified afterwards.
+var policy = &shutdownPolicy{}
+
+// policyHorizon bounds the search for the next time at which the policy
+// allows shutting down.
+const policyHorizon = 8 * 24 * time.Hour
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for idx, name := range weekdayNames {
+		if strings.EqualFold(s, name) {
+			return time.Weekday(idx), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q, expected one of %s", s, strings.Join(weekdayNames, ", "))
+}
+
+// parseClock parses HH:MM into the duration since midnight. 24:00 denotes the
+// end of the day.
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// window is a time of day range, starting on certain days of the week.
+type window struct {
+	spec       string
+	days       [7]bool
+	start, end time.Duration // since midnight
+}
+
+// parseWindow parses [days ]HH:MM-HH:MM, see -shutdown_windows.
+func parseWindow(s string) (window, error) {
+	w := window{spec: s}
+	days, clock, hasDays := strings.Cut(s, " ")
+	if !hasDays {
+		days, clock = "", s
+	}
+	if days == "" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		loStr, hiStr, isRange := strings.Cut(days, "-")
+		lo, err := parseWeekday(loStr)
+		if err != nil {
+			return window{}, fmt.Errorf("%q: %v", s, err)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parseWeekday(hiStr); err != nil {
+				return window{}, fmt.Errorf("%q: %v", s, err)
+			}
+		}
+		// Ranges can wrap around, e.g. fri-mon.
+		for d := lo; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == hi {
+				break
+			}
+		}
+	}
+	from, to, ok := strings.Cut(strings.TrimSpace(clock), "-")
+	if !ok {
+		return window{}, fmt.Errorf("%q is not in format [days ]HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return window{}, fmt.Errorf("%q: %v", s, err)
+	}
+	if w.start == 24*time.Hour {
+		return window{}, fmt.Errorf("%q: window cannot start at 24:00", s)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return window{}, fmt.Errorf("%q: %v", s, err)
+	}
+	return w, nil
+}
+
+// contains returns whether t is within the window.
+func (w *window) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	end := w.end
+	if end <= w.start {
+		end += 24 * time.Hour
+	}
+	// A window which extends into the next day could have started yesterday.
+	for _, offset := range []int{0, -1} {
+		midnight := time.Date(y, m, d+offset, 0, 0, 0, 0, t.Location())
+		if !w.days[midnight.Weekday()] {
+			continue
+		}
+		if !t.Before(midnight.Add(w.start)) && t.Before(midnight.Add(end)) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleTimeout overrides -idle during a window.
+type idleTimeout struct {
+	window
+	timeout time.Duration
+}
+
+// shutdownPolicy restricts when the machine may shut down once it is idle.
+type shutdownPolicy struct {
+	// windows during which shutting down is allowed. Empty means always.
+	windows []window
+	// timeouts override -idle during their windows.
+	timeouts []idleTimeout
+	// graceUntil is when the boot grace period ends.
+	graceUntil time.Time
+}
+
+// newShutdownPolicy parses -shutdown_windows and -idle_timeouts formatted
+// specifications.
+func newShutdownPolicy(windows, timeouts string, graceUntil time.Time) (*shutdownPolicy, error) {
+	p := &shutdownPolicy{graceUntil: graceUntil}
+	for _, spec := range strings.Split(windows, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("-shutdown_windows: %v", err)
+		}
+		p.windows = append(p.windows, w)
+	}
+	for _, entry := range strings.Split(timeouts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec, durStr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("-idle_timeouts: %q is not in format [days ]HH:MM-HH:MM=duration", entry)
+		}
+		w, err := parseWindow(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, fmt.Errorf("-idle_timeouts: %v", err)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(durStr))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("-idle_timeouts: %q: invalid duration %q", entry, durStr)
+		}
+		p.timeouts = append(p.timeouts, idleTimeout{window: w, timeout: timeout})
+	}
+	return p, nil
+}
+
+// bootTime returns when the machine booted, according to /proc/stat.
+func bootTime() (time.Time, error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("/proc/stat: invalid btime %q", v)
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("/proc/stat: btime not found")
+}
+
+// policyFromFlags returns the shutdown policy configured by flags.
+func policyFromFlags() (*shutdownPolicy, error) {
+	var graceUntil time.Time
+	if *bootGrace > 0 {
+		boot, err := bootTime()
+		if err != nil {
+			return nil, fmt.Errorf("-boot_grace: %v", err)
+		}
+		graceUntil = boot.Add(*bootGrace)
+	}
+	return newShutdownPolicy(*shutdownWindows, *idleTimeouts, graceUntil)
+}
+
+// idleTimeout returns how long the machine must be idle at t before shutting
+// down.
+func (p *shutdownPolicy) idleTimeout(t time.Time) time.Duration {
+	for idx := range p.timeouts {
+		if p.timeouts[idx].contains(t) {
+			return p.timeouts[idx].timeout
+		}
+	}
+	return *idleDuration
+}
+
+// allowed returns whether the policy allows shutting down at t, regardless of
+// the idle timeout.
+func (p *shutdownPolicy) allowed(t time.Time) bool {
+	if t.Before(p.graceUntil) {
+		return false
+	}
+	if len(p.windows) == 0 {
+		return true
+	}
+	for idx := range p.windows {
+		if p.windows[idx].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// restriction describes why the policy does not allow shutting down at t, or
+// returns the empty string if it does.
+func (p *shutdownPolicy) restriction(t time.Time) string {
+	if t.Before(p.graceUntil) {
+		return fmt.Sprintf("boot grace period (-boot_grace) until %s", p.graceUntil.Format(time.DateTime))
+	}
+	if !p.allowed(t) {
+		return "outside of -shutdown_windows"
+	}
+	return ""
+}
+
+// ready returns whether the machine may shut down at t, given that it has
+// been idle since idleSince.
+func (p *shutdownPolicy) ready(idleSince, t time.Time) bool {
+	return p.allowed(t) && t.Sub(idleSince) >= p.idleTimeout(t)
+}
+
+// shutdownAt returns the first time not before now at which the machine may
+// shut down if it stays idle, or the zero time if there is none within
+// policyHorizon.
+func (p *shutdownPolicy) shutdownAt(idleSince, now time.Time) time.Time {
+	var best time.Time
+	end := now.Add(policyHorizon)
+	consider := func(t time.Time) {
+		if !t.Before(now) && t.Before(end) && (best.IsZero() || t.Before(best)) && p.ready(idleSince, t) {
+			best = t
+		}
+	}
+	// Whether the machine may shut down changes when the idle timeout or the
+	// boot grace period elapses, or at the boundary of a window (full
+	// minutes).
+	consider(now)
+	consider(p.graceUntil)
+	consider(idleSince.Add(*idleDuration))
+	for _, it := range p.timeouts {
+		consider(idleSince.Add(it.timeout))
+	}
+	for t := now.Truncate(time.Minute).Add(time.Minute); t.Before(end) && (best.IsZero() || t.Before(best)); t = t.Add(time.Minute) {
+		if p.ready(idleSince, t) {
+			best = t
+		}
+	}
+	return best
+}
+
+// describe returns a description of the policy for the status page.
+func (p *shutdownPolicy) describe(now time.Time) []string {
+	lines := []string{fmt.Sprintf("idle timeout: %v", p.idleTimeout(now))}
+	for _, it := range p.timeouts {
+		lines = append(lines, fmt.Sprintf("idle timeout %v during %s (-idle_timeouts)", it.timeout, it.spec))
+	}
+	if len(p.windows) == 0 {
+		lines = append(lines, "shutting down allowed at any time")
+	}
+	for _, w := range p.windows {
+		lines = append(lines, fmt.Sprintf("shutting down allowed during %s (-shutdown_windows)", w.spec))
+	}
+	if !p.graceUntil.IsZero() {
+		lines = append(lines, fmt.Sprintf("no shutdown before %s (-boot_grace)", p.graceUntil.Format(time.DateTime)))
+	}
+	if *dryRun {
+		lines = append(lines, "dry run (-dry_run): hooks and action are only logged")
+	}
+	return lines
+}
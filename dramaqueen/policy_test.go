@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns the specified time in the week of Monday, 2026-10-12 (UTC), e.g.
+// at(t, "Sat 23:30").
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	dayStr, clock, _ := strings.Cut(s, " ")
+	wd, err := parseWeekday(dayStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseClock(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := (int(wd) + 6) % 7 // days since Monday
+	return time.Date(2026, 10, 12+day, 0, 0, 0, 0, time.UTC).Add(d)
+}
+
+func TestParseWindowInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"mon-fri",
+		"10:00",
+		"someday 10:00-11:00",
+		"mon-someday 10:00-11:00",
+		"24:00-01:00",
+		"10:00-25:00",
+	} {
+		if _, err := parseWindow(spec); err == nil {
+			t.Errorf("parseWindow(%q) unexpectedly succeeded", spec)
+		}
+	}
+	for _, timeouts := range []string{
+		"22:00-07:00",
+		"22:00-07:00=soon",
+		"22:00-07:00=-5m",
+	} {
+		if _, err := newShutdownPolicy("", timeouts, time.Time{}); err == nil {
+			t.Errorf("newShutdownPolicy(-idle_timeouts=%q) unexpectedly succeeded", timeouts)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		t    string
+		want bool
+	}{
+		{"10:00-11:00", "Wed 10:00", true},
+		{"10:00-11:00", "Wed 11:00", false},
+		{"mon-fri 22:00-07:00", "Mon 23:00", true},
+		{"mon-fri 22:00-07:00", "Tue 06:59", true},
+		{"mon-fri 22:00-07:00", "Mon 07:00", false},
+		// The window starting on Friday extends into Saturday.
+		{"mon-fri 22:00-07:00", "Sat 06:00", true},
+		{"mon-fri 22:00-07:00", "Sat 22:30", false},
+		{"mon-fri 22:00-07:00", "Mon 06:00", false},
+		{"sat-sun 00:00-24:00", "Sun 23:59", true},
+		{"sat-sun 00:00-24:00", "Mon 00:00", false},
+		// Ranges wrap around.
+		{"fri-mon 12:00-13:00", "Sun 12:30", true},
+		{"fri-mon 12:00-13:00", "Wed 12:30", false},
+	} {
+		w, err := parseWindow(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(at(t, tt.t)); got != tt.want {
+			t.Errorf("window %q contains %s = %v, want %v", tt.spec, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer func(old time.Duration) { *idleDuration = old }(*idleDuration)
+	*idleDuration = 10 * time.Minute
+	p, err := newShutdownPolicy("", "22:00-07:00=5m, sat-sun 00:00-24:00=1h", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		t    string
+		want time.Duration
+	}{
+		{"Mon 12:00", 10 * time.Minute},
+		{"Mon 23:00", 5 * time.Minute},
+		{"Sat 12:00", 1 * time.Hour},
+		// The first matching entry applies.
+		{"Sat 23:00", 5 * time.Minute},
+	} {
+		if got := p.idleTimeout(at(t, tt.t)); got != tt.want {
+			t.Errorf("idleTimeout(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestShutdownAt(t *testing.T) {
+	defer func(old time.Duration) { *idleDuration = old }(*idleDuration)
+	*idleDuration = 10 * time.Minute
+	for _, tt := range []struct {
+		desc       string
+		windows    string
+		timeouts   string
+		graceUntil string
+		idleSince  string
+		now        string
+		want       string
+		nextWeek   bool // whether want is in the following week
+	}{
+		{
+			desc:      "unrestricted",
+			idleSince: "Mon 12:00",
+			now:       "Mon 12:01",
+			want:      "Mon 12:10",
+		},
+		{
+			desc:      "idle timeout elapsed",
+			idleSince: "Mon 11:00",
+			now:       "Mon 12:00",
+			want:      "Mon 12:00",
+		},
+		{
+			desc:      "waiting for window",
+			windows:   "22:00-07:00",
+			idleSince: "Mon 11:00",
+			now:       "Mon 12:00",
+			want:      "Mon 22:00",
+		},
+		{
+			desc:      "waiting for window on the next day",
+			windows:   "sat-sun 00:00-24:00",
+			idleSince: "Fri 11:00",
+			now:       "Fri 12:00",
+			want:      "Sat 00:00",
+		},
+		{
+			// At 22:00, the machine was idle for only 2 minutes, but the
+			// shorter night time idle timeout applies from then on.
+			desc:      "shorter idle timeout at night",
+			timeouts:  "22:00-07:00=5m",
+			idleSince: "Mon 21:58",
+			now:       "Mon 21:58",
+			want:      "Mon 22:03",
+		},
+		{
+			desc:      "longer idle timeout at night",
+			timeouts:  "22:00-07:00=1h",
+			idleSince: "Mon 21:55",
+			now:       "Mon 21:58",
+			want:      "Mon 22:55",
+		},
+		{
+			desc:       "boot grace period",
+			graceUntil: "Mon 12:30",
+			idleSince:  "Mon 11:00",
+			now:        "Mon 12:00",
+			want:       "Mon 12:30",
+		},
+		{
+			desc:       "boot grace period and window",
+			windows:    "mon 12:00-12:15, mon 13:00-14:00",
+			graceUntil: "Mon 12:30",
+			idleSince:  "Mon 11:00",
+			now:        "Mon 12:00",
+			want:       "Mon 13:00",
+		},
+		{
+			desc:      "window just passed",
+			windows:   "sun 10:00-11:00",
+			idleSince: "Sun 11:00",
+			now:       "Sun 11:00",
+			want:      "Sun 10:00",
+			nextWeek:  true,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var graceUntil time.Time
+			if tt.graceUntil != "" {
+				graceUntil = at(t, tt.graceUntil)
+			}
+			p, err := newShutdownPolicy(tt.windows, tt.timeouts, graceUntil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := at(t, tt.want)
+			if tt.nextWeek {
+				want = want.AddDate(0, 0, 7)
+			}
+			got := p.shutdownAt(at(t, tt.idleSince), at(t, tt.now))
+			if !got.Equal(want) {
+				t.Errorf("shutdownAt = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// The boot grace period ends after policyHorizon.
+	now := at(t, "Mon 12:00")
+	p, err := newShutdownPolicy("", "", now.Add(policyHorizon+time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.shutdownAt(now.Add(-time.Hour), now); !got.IsZero() {
+		t.Errorf("shutdownAt = %v, want zero time", got)
+	}
+}
+
+func TestShutdownDryRun(t *testing.T) {
+	defer func(old bool) { *dryRun = old }(*dryRun)
+	defer func(old string) { *hooksDir = old }(*hooksDir)
+	*dryRun = true
+	*hooksDir = t.TempDir()
+	ran := filepath.Join(t.TempDir(), "ran")
+	hook := "#!/bin/sh\ntouch " + ran + "\n"
+	if err := os.WriteFile(filepath.Join(*hooksDir, "10-hook"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := shutdown()
+	if !errors.Is(err, errDryRun) {
+		t.Fatalf("shutdown() = %v, want %v", err, errDryRun)
+	}
+	if got, want := shutdownResult(err), "dry_run"; got != want {
+		t.Errorf("shutdownResult(%v) = %q, want %q", err, got, want)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Errorf("hook ran despite -dry_run")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/ping"
+)
+
+// sambaSource considers the machine in use while any of the hosts with samba
+// sessions responds to pings (with hysteresis, see clients).
+type sambaSource struct{}
+
+func (sambaSource) Name() string { return "samba" }
+
+func (sambaSource) Check(ctx context.Context) (bool, []string, error) {
+	hosts, err := getSessionHostnames(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	// Without any sessions, the machine is considered idle. This default
+	// will lead to a shutdown in case the machine gets booted and nobody
+	// starts using it within 10 minutes, which is intentional. The machine
+	// should only be booted when usage is imminent.
+	rtts := pingAll(ctx, hosts)
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	return updateClients(hosts, rtts), hosts, nil
+}
+
+// getSessionHostnames returns the hosts with samba sessions. The “net” command
+// fails e.g. while smbd is restarting.
+func getSessionHostnames(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, *netCommand, "status", "sessions", "parseable")
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("%v: %v: %s", cmd.Args, err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return parseSessions(out), nil
+}
+
+// parseSessions parses the output of “net status sessions parseable” and
+// returns the (deduplicated) hostnames.
+//
+// NB: Even though it says hostname, on my machine this is an IP address.
+func parseSessions(out []byte) []string {
+	// from samba/2:3.6.16-1/source3/utils/net_status.c:
+	// if (*parseable) {
+	// 		d_printf("%s\\%s\\%s\\%s\\%s\n",
+	// 			 procid_str_static(&session->pid),
+	// 			 uidtoname(session->uid),
+	// 			 gidtoname(session->gid),
+	// 			 session->remote_machine, session->hostname);
+	// 	}
+	//
+	// Backslashes within fields (e.g. DOMAIN\user) are not escaped, so the
+	// hostname is the last field of lines with at least 5 fields.
+	hostnames := []string{}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "\\")
+		if len(parts) < 5 {
+			log.Printf("[samba] skipping malformed session line %q", line)
+			continue
+		}
+		host := sessionHost(parts[len(parts)-1])
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hostnames = append(hostnames, host)
+	}
+	return hostnames
+}
+
+// sessionHost strips the address family and port which Samba 4 prints as part
+// of the hostname, e.g. ipv4:10.0.0.34:50412 or ipv6:fe80::1:50412.
+func sessionHost(field string) string {
+	for _, family := range []string{"ipv4:", "ipv6:"} {
+		if addr, ok := strings.CutPrefix(field, family); ok {
+			if idx := strings.LastIndex(addr, ":"); idx != -1 {
+				addr = addr[:idx]
+			}
+			return addr
+		}
+	}
+	return field
+}
+
+// pingAll pings all hosts concurrently and returns the round trip time of each
+// host which replied.
+func pingAll(ctx context.Context, hosts []string) map[string]time.Duration {
+	ctx, canc := context.WithTimeout(ctx, 10*time.Second)
+	defer canc()
+	pinger := ping.Pinger{
+		Timeout:    5 * time.Second,
+		Privileged: !*unprivilegedPing,
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		rtts = make(map[string]time.Duration)
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, err := pinger.Ping(ctx, host)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[ping %s] %v", host, err)
+				}
+				return
+			}
+			if stats.Received > 0 {
+				mu.Lock()
+				rtts[host] = stats.Avg
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return rtts
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/dramaqueen"
+)
+
+func TestParseSessions(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		want    []string
+	}{
+		{"sessions-empty.txt", []string{}},
+		{"sessions-samba3.txt", []string{"10.0.0.34", "10.0.0.76"}},
+		// Samba 4 prints the address family and port, usernames can contain
+		// backslashes, and hosts with multiple sessions are listed once.
+		{"sessions-samba4.txt", []string{"10.0.0.76", "10.0.0.81", "fe80::1c2b:3ff:fe4a:5b6c"}},
+		// Lines with only 4 fields used to panic.
+		{"sessions-malformed.txt", []string{"10.0.0.76"}},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parseSessions(b); !slices.Equal(got, tt.want) {
+				t.Errorf("parseSessions(%s) = %q, want %q", tt.fixture, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSambaSourceNetFails(t *testing.T) {
+	defer func(old string) { *netCommand = old }(*netCommand)
+	*netCommand = "testdata/net-fails.sh"
+	active, _, err := sambaSource{}.Check(context.Background())
+	if err == nil {
+		t.Fatalf("Check unexpectedly succeeded (active = %v)", active)
+	}
+	if want := "sessionid.tdb"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Check error %q does not contain the stderr output %q", err, want)
+	}
+}
+
+func TestUpdateActivityUnavailable(t *testing.T) {
+	defer func(old bool) { *unavailableIsBusy = old }(*unavailableIsBusy)
+	errFailed := errors.New("net failed")
+
+	for _, busy := range []bool{true, false} {
+		*unavailableIsBusy = busy
+		var a dramaqueen.Activity
+		updateActivity(&a, false, nil, errFailed)
+		updateActivity(&a, false, nil, errFailed)
+		if !a.Unavailable || a.Active != busy || a.Errors != 2 || a.Error != errFailed.Error() {
+			t.Errorf("-unavailable_is_busy=%v: after 2 failed checks: %+v", busy, a)
+		}
+
+		updateActivity(&a, false, nil, nil)
+		if a.Unavailable || a.Active || a.Errors != 2 || a.Error != "" {
+			t.Errorf("-unavailable_is_busy=%v: after a successful check: %+v", busy, a)
+		}
+	}
+
+	// Activity found despite an error (e.g. one of multiple HTTP probes
+	// failed) is not affected by the policy.
+	*unavailableIsBusy = false
+	var a dramaqueen.Activity
+	updateActivity(&a, true, []string{"http://jellyfin/Sessions"}, errFailed)
+	if a.Unavailable || !a.Active {
+		t.Errorf("partially failed check with activity: %+v", a)
+	}
+}
+
+func TestClientHysteresis(t *testing.T) {
+	defer func(up, down time.Duration) {
+		*clientUpDelay, *clientDownDelay = up, down
+	}(*clientUpDelay, *clientDownDelay)
+	defer func(old map[string]*client) { clients = old }(clients)
+	clients = make(map[string]*client)
+	const host = "10.0.0.76"
+	reply := map[string]time.Duration{host: time.Millisecond}
+
+	// A laptop waking up briefly does not count as activity.
+	*clientUpDelay, *clientDownDelay = time.Hour, time.Hour
+	if updateClients([]string{host}, reply) {
+		t.Errorf("client active before -client_up_delay passed")
+	}
+	if c := clients[host]; !c.reachable.Value() || c.lastSeen.IsZero() {
+		t.Errorf("reply not recorded: reachable = %v, last seen = %v", c.reachable.Value(), c.lastSeen)
+	}
+
+	*clientUpDelay = 0
+	if !updateClients([]string{host}, reply) {
+		t.Errorf("client not active after -client_up_delay passed")
+	}
+
+	// A single dropped ping does not start the idle timer.
+	if !updateClients([]string{host}, nil) {
+		t.Errorf("client inactive before -client_down_delay passed")
+	}
+
+	*clientDownDelay = 0
+	if updateClients([]string{host}, nil) {
+		t.Errorf("client still active after -client_down_delay passed")
+	}
+
+	// Hosts whose sessions ended are forgotten.
+	updateClients(nil, nil)
+	if len(clients) > 0 {
+		t.Errorf("clients without sessions not forgotten: %v", clients)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var (
+	action = flag.String("action",
+		"poweroff",
+		"what to do once the machine is idle: poweroff, suspend, hibernate, hybrid-sleep (via systemctl) or command (see -action_command).")
+	actionCommand = flag.String("action_command",
+		"",
+		"shell command to run for -action=command, e.g. “rtcwake -m mem -s 43200”.")
+	hooksDir = flag.String("hooks_dir",
+		"",
+		"directory of executables to run (in lexical order) before the action, called as “<hook> pre <action>”. Should activity appear while the hooks run, the action is canceled and the hooks which ran are called as “<hook> cancel <action>”. After resuming from suspend or hibernation, all hooks are called as “<hook> post <action>”.")
+	hookTimeout = flag.Duration("hook_timeout",
+		2*time.Minute,
+		"maximum duration of each hook.")
+)
+
+// actionCheckTimeout is how long to wait for the action to take effect.
+const actionCheckTimeout = 60 * time.Second
+
+// lastShutdown describes the most recent shutdown attempt for the status
+// page. Guarded by statusLock.
+var lastShutdown struct {
+	Start  time.Time
+	Action string
+	Result string
+}
+
+func validateAction() error {
+	switch *action {
+	case "poweroff", "suspend", "hibernate", "hybrid-sleep":
+		return nil
+	case "command":
+		if *actionCommand == "" {
+			return errors.New("-action=command requires -action_command")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown -action=%q (expected poweroff, suspend, hibernate, hybrid-sleep or command)", *action)
+	}
+}
+
+func actionCmd() *exec.Cmd {
+	if *action == "command" {
+		return exec.Command("/bin/sh", "-c", *actionCommand)
+	}
+	return exec.Command("systemctl", *action)
+}
+
+// shutdownPossible returns whether there is neither activity nor an inhibitor.
+// statusLock must be held.
+func shutdownPossible() bool {
+	return len(activeSources()) == 0 && len(inhibitors) == 0
+}
+
+// errDryRun is returned by shutdown with -dry_run.
+var errDryRun = errors.New("dry run (-dry_run)")
+
+// errShutdownCanceled is returned by shutdown when activity appeared while
+// running hooks.
+var errShutdownCanceled = errors.New("canceled: activity appeared while running hooks")
+
+// hooks returns the executables in -hooks_dir, sorted by name.
+func hooks() ([]string, error) {
+	if *hooksDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(*hooksDir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		result = append(result, filepath.Join(*hooksDir, e.Name()))
+	}
+	return result, nil
+}
+
+func runHook(hook, phase string) error {
+	ctx, canc := context.WithTimeout(context.Background(), *hookTimeout)
+	defer canc()
+	cmd := exec.CommandContext(ctx, hook, phase, *action)
+	cmd.Env = append(os.Environ(), "DRAMAQUEEN_ACTION="+*action)
+	out, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		log.Printf("[hook %s %s] %s", filepath.Base(hook), phase, scanner.Text())
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return nil
+}
+
+// runHooks runs all hooks with the specified phase, logging errors.
+func runHooks(hooks []string, phase string) {
+	for _, hook := range hooks {
+		if err := runHook(hook, phase); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// suspendedSince returns roughly how long the machine was suspended (or
+// hibernated) since t: the monotonic clock does not advance while the machine
+// is suspended, the wall clock does.
+func suspendedSince(t time.Time) time.Duration {
+	now := time.Now()
+	return now.Round(0).Sub(t.Round(0)) - now.Sub(t)
+}
+
+// verifyAction waits until the action triggered at start took effect: for
+// poweroff, this process should be terminated; for suspend or hibernation,
+// the machine should have been suspended (systemctl returns after resuming).
+func verifyAction(start time.Time) error {
+	for deadline := time.Now().Add(actionCheckTimeout); time.Now().Before(deadline); time.Sleep(1 * time.Second) {
+		if suspended := suspendedSince(start); suspended > 5*time.Second {
+			log.Printf("resumed after being suspended for %v", suspended.Round(time.Second))
+			return nil
+		}
+	}
+	return fmt.Errorf("machine still running %v after -action=%s", actionCheckTimeout, *action)
+}
+
+// shutdown runs the pre-action hooks and then the action. It returns
+// errShutdownCanceled if activity appears while hooks are running.
+func shutdown() error {
+	hooks, err := hooks()
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return fmt.Errorf("%w: would run hooks %q and %q", errDryRun, hooks, actionCmd().Args)
+	}
+	var ran []string
+	cancel := func() {
+		for i := len(ran) - 1; i >= 0; i-- {
+			if err := runHook(ran[i], "cancel"); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	for _, hook := range hooks {
+		ran = append(ran, hook)
+		if err := runHook(hook, "pre"); err != nil {
+			cancel()
+			return err
+		}
+		statusLock.Lock()
+		possible := shutdownPossible()
+		statusLock.Unlock()
+		if !possible {
+			cancel()
+			return errShutdownCanceled
+		}
+	}
+
+	start := time.Now()
+	cmd := actionCmd()
+	log.Printf("machine idle, running %v", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		cancel()
+		return fmt.Errorf("%v: %v: %s", cmd.Args, err, bytes.TrimSpace(out))
+	}
+	if err := verifyAction(start); err != nil {
+		cancel()
+		return err
+	}
+	runHooks(hooks, "post")
+	return nil
+}
+
+// shutdownAndRecord calls shutdown and records the result for the status
+// page.
+func shutdownAndRecord() {
+	statusLock.Lock()
+	lastShutdown.Start = time.Now()
+	lastShutdown.Action = *action
+	lastShutdown.Result = "running"
+	statusLock.Unlock()
+	notifyStateChanged()
+
+	result := "done"
+	err := shutdown()
+	if err != nil {
+		log.Printf("-action=%s: %v", *action, err)
+		result = err.Error()
+	}
+	shutdowns.WithLabelValues(*action, shutdownResult(err)).Inc()
+
+	statusLock.Lock()
+	lastShutdown.Result = result
+	// Whether the machine resumed or the shutdown failed or was canceled
+	// (or only logged with -dry_run), it must be idle for -idle again before
+	// the next attempt.
+	idleSince = time.Time{}
+	statusLock.Unlock()
+	notifyStateChanged()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stapelberg/zkj-nas-tools/internal/utmp"
+)
+
+var (
+	utmpPath = flag.String("utmp_path",
+		"/var/run/utmp",
+		"utmp file listing logins (e.g. via SSH), which count as activity. Empty disables.")
+	nfsdClientsDir = flag.String("nfsd_clients_dir",
+		"/proc/fs/nfsd/clients",
+		"directory listing the NFSv4 clients of the kernel NFS server, which count as activity while they have the export mounted. Empty disables.")
+	tcpPorts = flag.String("tcp_ports",
+		"",
+		"comma-separated list of local TCP ports (e.g. 8096 for Jellyfin), established connections to which (see /proc/net/tcp) count as activity.")
+	httpProbes = flag.String("http_probes",
+		"",
+		"comma-separated list of URLs (e.g. “now playing” endpoints of media servers) which count as activity when they return HTTP 200 with a body other than empty, [], {} or null.")
+)
+
+// sshSource considers the machine in use while somebody is logged in.
+type sshSource struct {
+	path string
+}
+
+func (sshSource) Name() string { return "ssh" }
+
+func (s sshSource) Check(ctx context.Context) (bool, []string, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil, nil // logins are not recorded on this machine
+		}
+		return false, nil, err
+	}
+	defer f.Close()
+	var logins []string
+	r := bufio.NewReader(f)
+	for {
+		u, err := utmp.ReadRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, nil, fmt.Errorf("%s: %v", s.path, err)
+		}
+		if u.Type() != utmp.UserProcess {
+			continue
+		}
+		// Records of crashed sessions are not necessarily cleaned up.
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(u.Pid()))); err != nil {
+			continue
+		}
+		login := u.User() + " on " + u.Device()
+		if host := u.Host(); host != "" {
+			login += " from " + host
+		}
+		logins = append(logins, login)
+	}
+	return len(logins) > 0, logins, nil
+}
+
+// nfsSource considers the machine in use while NFSv4 clients are connected.
+type nfsSource struct {
+	dir string
+}
+
+func (nfsSource) Name() string { return "nfs" }
+
+func (s nfsSource) Check(ctx context.Context) (bool, []string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil, nil // nfsd is not running
+		}
+		return false, nil, err
+	}
+	var clients []string
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(s.dir, e.Name(), "info"))
+		if err != nil {
+			continue // the client went away meanwhile
+		}
+		clients = append(clients, nfsClientAddress(string(b), e.Name()))
+	}
+	return len(clients) > 0, clients, nil
+}
+
+// nfsClientAddress returns the address line of an nfsd client info file, e.g.
+// address: "10.0.0.76:833", or fallback if there is none.
+func nfsClientAddress(info, fallback string) string {
+	for _, line := range strings.Split(info, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && key == "address" {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return fallback
+}
+
+// tcpSource considers the machine in use while TCP connections to any of ports
+// are established.
+type tcpSource struct {
+	ports map[uint16]bool
+}
+
+func newTCPSource(list string) (tcpSource, error) {
+	src := tcpSource{ports: make(map[uint16]bool)}
+	for _, p := range strings.Split(list, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil {
+			return tcpSource{}, fmt.Errorf("invalid port %q", p)
+		}
+		src.ports[uint16(port)] = true
+	}
+	return src, nil
+}
+
+func (tcpSource) Name() string { return "tcp" }
+
+func (s tcpSource) Check(ctx context.Context) (bool, []string, error) {
+	var conns []string
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // e.g. IPv6 disabled
+			}
+			return false, nil, err
+		}
+		c, err := establishedConns(f, s.ports)
+		f.Close()
+		if err != nil {
+			return false, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		conns = append(conns, c...)
+	}
+	return len(conns) > 0, conns, nil
+}
+
+// tcpEstablished is the TCP_ESTABLISHED state in /proc/net/tcp.
+const tcpEstablished = "01"
+
+// establishedConns parses r in /proc/net/tcp format and returns the
+// established connections to any of ports.
+func establishedConns(r io.Reader, ports map[uint16]bool) ([]string, error) {
+	var conns []string
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		// sl local_address rem_address st …
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if !ports[local.Port()] {
+			continue
+		}
+		remote, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, fmt.Sprintf("%v to port %d", remote, local.Port()))
+	}
+	return conns, scanner.Err()
+}
+
+// parseProcNetAddr parses an address like 0100007F:1F90 (127.0.0.1:8080). The
+// IP address is printed as 32-bit words in host byte order (little endian on
+// all architectures we run on).
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q: %v", s, err)
+	}
+	b, err := hex.DecodeString(hexIP)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	for word := 0; word < len(b); word += 4 {
+		b[word], b[word+1], b[word+2], b[word+3] = b[word+3], b[word+2], b[word+1], b[word]
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+}
+
+// httpSource considers the machine in use while any of the probed URLs
+// returns a non-empty response.
+type httpSource struct {
+	urls []*url.URL
+}
+
+func newHTTPSource(list string) (httpSource, error) {
+	var src httpSource
+	for _, s := range strings.Split(list, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return httpSource{}, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return httpSource{}, fmt.Errorf("%q is not an http or https URL", s)
+		}
+		src.urls = append(src.urls, u)
+	}
+	return src, nil
+}
+
+func (httpSource) Name() string { return "http" }
+
+// redacted returns u without query parameters and user info, which might
+// contain API keys.
+func redacted(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+func (s httpSource) Check(ctx context.Context) (bool, []string, error) {
+	var (
+		active []string
+		errs   []error
+	)
+	for _, u := range s.urls {
+		ok, err := probe(ctx, u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", redacted(u), err))
+			continue
+		}
+		if ok {
+			active = append(active, redacted(u))
+		}
+	}
+	return len(active) > 0, active, errors.Join(errs...)
+}
+
+func probe(ctx context.Context, u *url.URL) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Do not log the URL, which is part of the error.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return false, uerr.Err
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "", "[]", "{}", "null":
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,4 @@
+#!/bin/sh
+# Behaves like “net status sessions parseable” while smbd is restarting.
+echo "failed to open sessionid.tdb" >&2
+exit 1
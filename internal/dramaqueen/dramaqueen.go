@@ -0,0 +1,330 @@
+// Package dramaqueen is a client for dramaqueen, which shuts down a NAS once
+// nobody is using it anymore. Programs which need the NAS to stay up (e.g.
+// dornröschen while backing up) hold an inhibitor.
+//
+// Inhibitors are leases: they are identified by a key, held by an owner and
+// expire unless renewed. Acquiring an inhibitor which is held by a different
+// owner fails with a *ConflictError, acquiring it again as the same owner
+// renews it.
+package dramaqueen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPort is the port on which dramaqueen listens by default.
+const DefaultPort = 4414
+
+// Inhibitor prevents dramaqueen from shutting down the machine.
+type Inhibitor struct {
+	Key    string `json:"key"`
+	Owner  string `json:"owner,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Since is when the inhibitor was acquired (renewing does not change it).
+	Since time.Time `json:"since"`
+	// Expires is when the inhibitor is removed unless renewed. The zero time
+	// means never.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Expired returns whether the inhibitor has expired at t.
+func (i *Inhibitor) Expired(t time.Time) bool {
+	return !i.Expires.IsZero() && !t.Before(i.Expires)
+}
+
+// ConflictError is returned when acquiring an inhibitor which is held by a
+// different owner.
+type ConflictError struct {
+	Held Inhibitor
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("inhibitor %q is held by %q since %v (reason: %q)",
+		e.Held.Key, e.Held.Owner, e.Held.Since.Format(time.DateTime), e.Held.Reason)
+}
+
+// InhibitRequest is the body of POST /api/v1/inhibitors.
+type InhibitRequest struct {
+	Key    string `json:"key"`
+	Owner  string `json:"owner,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// TTL is a duration like "30m". If empty, the dramaqueen default applies.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// Sessions is returned by GET /api/v1/sessions.
+type Sessions struct {
+	// Hosts are the hosts with samba sessions.
+	Hosts []string `json:"hosts"`
+	// Reachable is whether any of the hosts is active (see Clients).
+	Reachable bool          `json:"reachable"`
+	Clients   []SambaClient `json:"clients"`
+}
+
+// SambaClient is a host with samba sessions.
+type SambaClient struct {
+	Host string `json:"host"`
+	// Reachable is whether the host responded to the most recent ping.
+	Reachable bool `json:"reachable"`
+	// Active follows Reachable after a delay (hysteresis), so that a single
+	// dropped ping or a laptop waking up briefly does not matter.
+	Active bool `json:"active"`
+	// Since is when Active last changed.
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+// Activity is the most recent result of an activity source (samba, ssh, nfs,
+// tcp or http), returned by GET /api/v1/activity.
+type Activity struct {
+	Source string `json:"source"`
+	Active bool   `json:"active"`
+	// Details describe the activity, e.g. client addresses.
+	Details []string `json:"details,omitempty"`
+	// Unavailable is set while the source cannot be checked (see Error).
+	// Depending on the dramaqueen configuration, unavailable sources are
+	// considered active.
+	Unavailable bool   `json:"unavailable,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Errors is the number of failed checks since dramaqueen started.
+	Errors  int       `json:"errors,omitempty"`
+	Checked time.Time `json:"checked,omitzero"`
+}
+
+// Idle is returned by GET /api/v1/idle.
+type Idle struct {
+	// ShutdownPossible is false while there is activity or there are
+	// inhibitors, see BlockedBy.
+	ShutdownPossible bool     `json:"shutdown_possible"`
+	BlockedBy        []string `json:"blocked_by,omitempty"`
+	// IdleSince is when shutting down became possible.
+	IdleSince time.Time `json:"idle_since,omitzero"`
+	// IdleTimeoutSeconds is the idle timeout in effect now (see -idle and
+	// -idle_timeouts).
+	IdleTimeoutSeconds int64 `json:"idle_timeout_seconds"`
+	// Restriction is set while the shutdown policy does not allow shutting
+	// down, e.g. outside of -shutdown_windows.
+	Restriction string `json:"restriction,omitempty"`
+	// Action is what dramaqueen does once the machine is idle: poweroff,
+	// suspend, hibernate, hybrid-sleep or command.
+	Action string `json:"action"`
+	// DryRun is set if dramaqueen only logs what it would do (-dry_run).
+	DryRun bool `json:"dry_run,omitempty"`
+	// ShuttingDown is set while dramaqueen runs hooks and the action.
+	ShuttingDown bool `json:"shutting_down,omitempty"`
+	// ShutdownAt is when dramaqueen will shut down the machine, unless
+	// activity is detected or an inhibitor is acquired until then. It is
+	// zero if the shutdown policy does not allow shutting down within the
+	// next 8 days.
+	ShutdownAt       time.Time `json:"shutdown_at,omitzero"`
+	RemainingSeconds int64     `json:"remaining_seconds,omitempty"`
+}
+
+// State is returned by GET /api/v1/state.
+type State struct {
+	Sessions   Sessions    `json:"sessions"`
+	Activity   []Activity  `json:"activity"`
+	Inhibitors []Inhibitor `json:"inhibitors"`
+	Idle       Idle        `json:"idle"`
+}
+
+// APIError is returned for unexpected HTTP responses.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+	// Inhibitor is the conflicting inhibitor for HTTP 409 (Conflict).
+	Inhibitor *Inhibitor `json:"inhibitor,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to the dramaqueen running on Host.
+type Client struct {
+	// Host is the host name or IP address (optionally with :port) of the
+	// machine running dramaqueen.
+	Host string
+	// Owner identifies the program holding inhibitors, e.g.
+	// dornröschen@hostname.
+	Owner string
+	// HTTPClient is used for requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func (c *Client) url(path string) string {
+	host := c.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(DefaultPort))
+	}
+	return "http://" + host + path
+}
+
+// do sends a request with the JSON encoding of body (unless nil) and returns
+// the response if its status code is one of expected. Otherwise, the returned
+// error is an *APIError, or a *ConflictError for HTTP 409 (Conflict).
+func (c *Client) do(ctx context.Context, method, path string, body any, expected ...int) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(expected, resp.StatusCode) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	if err := json.Unmarshal(b, apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(b))
+	}
+	if resp.StatusCode == http.StatusConflict && apiErr.Inhibitor != nil {
+		return nil, &ConflictError{Held: *apiErr.Inhibitor}
+	}
+	return nil, apiErr
+}
+
+// get decodes the JSON response to a GET request for path into v.
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, "GET", path, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Inhibit acquires (or, if already held by c.Owner, renews) the inhibitor
+// key, which expires after ttl unless renewed.
+func (c *Client) Inhibit(ctx context.Context, key, reason string, ttl time.Duration) (*Inhibitor, error) {
+	resp, err := c.do(ctx, "POST", "/api/v1/inhibitors", InhibitRequest{
+		Key:    key,
+		Owner:  c.Owner,
+		Reason: reason,
+		TTL:    ttl.String(),
+	}, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var inh Inhibitor
+	if err := json.NewDecoder(resp.Body).Decode(&inh); err != nil {
+		return nil, err
+	}
+	return &inh, nil
+}
+
+// Release releases the inhibitor key. Releasing an inhibitor which does not
+// exist (e.g. because it expired) is not an error.
+func (c *Client) Release(ctx context.Context, key string) error {
+	path := "/api/v1/inhibitors/" + url.PathEscape(key) + "?" + url.Values{"owner": {c.Owner}}.Encode()
+	resp, err := c.do(ctx, "DELETE", path, nil, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// State returns the current state of dramaqueen.
+func (c *Client) State(ctx context.Context) (*State, error) {
+	var st State
+	if err := c.get(ctx, "/api/v1/state", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Idle returns whether and when dramaqueen is going to shut down the machine.
+func (c *Client) Idle(ctx context.Context) (*Idle, error) {
+	var idle Idle
+	if err := c.get(ctx, "/api/v1/idle", &idle); err != nil {
+		return nil, err
+	}
+	return &idle, nil
+}
+
+// Lease is an inhibitor which is renewed in the background until it is
+// released.
+type Lease struct {
+	c      *Client
+	key    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Acquire acquires the inhibitor key and renews it every ttl/3 until Release
+// is called. Should the lease holder crash, the inhibitor expires after ttl,
+// which must be positive.
+func (c *Client) Acquire(ctx context.Context, key, reason string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid lease ttl %v: must be positive", ttl)
+	}
+	if _, err := c.Inhibit(ctx, key, reason, ttl); err != nil {
+		return nil, err
+	}
+	renewCtx, cancel := context.WithCancel(context.Background())
+	l := &Lease{
+		c:      c,
+		key:    key,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Renewal failures are only logged: the inhibitor stays valid
+			// until it expires, and the next renewal might succeed.
+			if _, err := c.Inhibit(renewCtx, key, reason, ttl); err != nil && renewCtx.Err() == nil {
+				log.Printf("dramaqueen(%s): renewing inhibitor %q: %v", c.Host, key, err)
+			}
+		}
+	}()
+	return l, nil
+}
+
+// Release stops renewing the inhibitor and releases it.
+func (l *Lease) Release() error {
+	l.cancel()
+	<-l.done
+	ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer canc()
+	return l.c.Release(ctx, l.key)
+}
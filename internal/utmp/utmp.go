@@ -87,6 +87,10 @@ func (u *Utmp) User() string {
 	return string(u.record.User[:getByteLen(u.record.User[:])])
 }
 
+func (u *Utmp) Host() string {
+	return string(u.record.Host[:getByteLen(u.record.Host[:])])
+}
+
 func (u *Utmp) Session() int {
 	return int(u.record.Session)
 }
@@ -0,0 +1,223 @@
+package wake
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type Host struct {
+	Name          string `json:"name"`
+	IP            string `json:"ip"`
+	MAC           string `json:"mac,omitempty"`
+	Relay         string `json:"relay,omitempty"` // webwake instance
+	UnlockCommand string `json:"unlock_command,omitempty"`
+	SmartPlug     string `json:"smart_plug,omitempty"` // ESPHome smart plug hostname for power control
+
+	// Power selects the PowerController. If unset, SmartPlug (if any) or
+	// Wake-on-LAN is used.
+	Power *PowerConfig `json:"power,omitempty"`
+
+	// WOL configures how Wake-on-LAN magic packets are sent to MAC.
+	WOL *WOLConfig `json:"wol,omitempty"`
+
+	// Readiness lists the probes which need to succeed (in order) before the
+	// host is considered up, in addition to SSH (tcp/22) being reachable.
+	Readiness []Probe `json:"readiness,omitempty"`
+}
+
+// inventory is the on-disk format of the host inventory file, e.g.:
+//
+//	{
+//	  "hosts": [
+//	    {
+//	      "name": "storage3",
+//	      "ip": "10.0.0.253",
+//	      "mac": "70:85:c2:8d:b9:76",
+//	      "relay": "router7",
+//	      "smart_plug": "plug-storage3.lan"
+//	    }
+//	  ]
+//	}
+type inventory struct {
+	Hosts []Host `json:"hosts"`
+}
+
+// defaultInventory is used until (or unless) LoadHosts succeeds. midna and
+// mixna have static DHCP leases. storage2 has no MAC: it is woken up via its
+// smart plug (BIOS: restore on AC power).
+//
+//go:embed hosts.json
+var defaultInventory []byte
+
+var (
+	hostsMu sync.RWMutex
+	hosts   = mustParseHosts(defaultInventory)
+)
+
+func mustParseHosts(b []byte) map[string]Host {
+	m, err := ParseHosts(b)
+	if err != nil {
+		panic(fmt.Sprintf("built-in host inventory: %v", err))
+	}
+	return m
+}
+
+// hostnameRe matches RFC 1123 host names (one or more dot-separated labels).
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+func validHostname(name string) bool {
+	return len(name) <= 253 && hostnameRe.MatchString(name)
+}
+
+func (h *Host) validate() error {
+	if h.Name == "" {
+		return errors.New("name is empty")
+	}
+	if net.ParseIP(h.IP) == nil {
+		return fmt.Errorf("invalid IP address %q", h.IP)
+	}
+	if h.MAC != "" {
+		hwaddr, err := net.ParseMAC(h.MAC)
+		if err != nil {
+			return err
+		}
+		if got, want := len(hwaddr), 6; got != want {
+			return fmt.Errorf("MAC address %q has %d bytes, want %d", h.MAC, got, want)
+		}
+	}
+	if h.Relay != "" && !validHostname(h.Relay) {
+		return fmt.Errorf("invalid relay name %q", h.Relay)
+	}
+	if h.SmartPlug != "" && !validHostname(h.SmartPlug) {
+		return fmt.Errorf("invalid smart plug hostname %q", h.SmartPlug)
+	}
+	if h.WOL != nil {
+		if err := h.WOL.validate(); err != nil {
+			return fmt.Errorf("wol: %v", err)
+		}
+	}
+	if h.Power != nil {
+		if err := h.Power.validate(); err != nil {
+			return err
+		}
+	}
+	for idx, p := range h.Readiness {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("readiness probe %d: %v", idx, err)
+		}
+	}
+	return nil
+}
+
+// ParseHosts parses and validates a host inventory in JSON format, returning
+// the hosts keyed by name.
+func ParseHosts(b []byte) (map[string]Host, error) {
+	var inv inventory
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&inv); err != nil {
+		return nil, err
+	}
+	m := make(map[string]Host, len(inv.Hosts))
+	for idx, h := range inv.Hosts {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("host %d (%q): %v", idx, h.Name, err)
+		}
+		if _, ok := m[h.Name]; ok {
+			return nil, fmt.Errorf("host %q: duplicate name", h.Name)
+		}
+		m[h.Name] = h
+	}
+	return m, nil
+}
+
+// LoadHosts reads the host inventory from path and, if it is valid, replaces
+// the currently loaded inventory. On error, the previous inventory stays in
+// effect.
+func LoadHosts(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m, err := ParseHosts(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	hosts = m
+	return nil
+}
+
+// LoadHostsAndWatch loads the host inventory from path (keeping the built-in
+// inventory if path does not exist) and re-loads it whenever the process
+// receives SIGHUP.
+func LoadHostsAndWatch(path string) error {
+	if err := LoadHosts(path); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("host inventory %s not found, using built-in inventory", path)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := LoadHosts(path); err != nil {
+				log.Printf("reloading host inventory: %v", err)
+				continue
+			}
+			log.Printf("reloaded host inventory from %s", path)
+		}
+	}()
+	return nil
+}
+
+// LookupHost returns the host with the specified name.
+func LookupHost(name string) (Host, bool) {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	h, ok := hosts[name]
+	return h, ok
+}
+
+// LookupHostByIP returns the host with the specified IP address.
+func LookupHostByIP(ip string) (Host, bool) {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	for _, h := range hosts {
+		if h.IP == ip {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
+
+// HostNames returns the sorted names of all hosts in the inventory.
+func HostNames() []string {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	return slices.Sorted(maps.Keys(hosts))
+}
+
+// Hosts returns all hosts in the inventory, sorted by name.
+func Hosts() []Host {
+	hostsMu.RLock()
+	defer hostsMu.RUnlock()
+	return slices.SortedFunc(maps.Values(hosts), func(a, b Host) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
@@ -0,0 +1,541 @@
+package wake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gokrazy/gokrazy/ifaddr"
+	"github.com/stapelberg/zkj-nas-tools/internal/wakeonlan"
+)
+
+// PowerController turns a machine on and resets it.
+type PowerController interface {
+	// Wake powers up a machine which is turned off.
+	Wake(ctx context.Context) error
+
+	// PowerCycle forcibly cuts power and restores it, e.g. to reset a hung
+	// machine. Returns ErrUnsupported if the controller cannot cut power.
+	PowerCycle(ctx context.Context) error
+
+	// String describes the controller for log messages and progress reports.
+	String() string
+}
+
+// ErrUnsupported is returned by PowerController implementations for operations
+// which they cannot perform.
+var ErrUnsupported = errors.New("operation not supported by power controller")
+
+// PowerConfig selects and configures the PowerController of a host.
+type PowerConfig struct {
+	// Type is one of "esphome", "shelly", "tasmota", "ipmi", "mqtt" or "wol".
+	Type string `json:"type"`
+
+	// Host is the hostname of the smart plug (esphome, shelly, tasmota) or
+	// of the BMC (ipmi).
+	Host string `json:"host,omitempty"`
+
+	// Switch is the switch id (shelly) or relay index (tasmota, default 1).
+	Switch int `json:"switch,omitempty"`
+
+	// User and PasswordFile are the IPMI credentials.
+	User         string `json:"user,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	// Command is the ipmitool-compatible program to run (default ipmitool).
+	Command string `json:"command,omitempty"`
+
+	// Broker is the MQTT broker address (default tcp://mqtt.lan:1883).
+	Broker string `json:"broker,omitempty"`
+	// Topic is the MQTT topic to which "wake" and "power_cycle" commands are
+	// published.
+	Topic string `json:"topic,omitempty"`
+}
+
+func (p *PowerConfig) validate() error {
+	switch p.Type {
+	case "esphome", "shelly", "tasmota", "ipmi":
+		if !validHostname(p.Host) {
+			return fmt.Errorf("%s power controller: invalid hostname %q", p.Type, p.Host)
+		}
+	case "mqtt":
+		if p.Topic == "" {
+			return errors.New("mqtt power controller: topic is empty")
+		}
+	case "wol":
+	default:
+		return fmt.Errorf("unknown power controller type %q", p.Type)
+	}
+	return nil
+}
+
+// PowerController returns the PowerController configured for the host. Hosts
+// without explicit power configuration use their ESPHome SmartPlug, if any, or
+// Wake-on-LAN otherwise.
+func (h Host) PowerController() (PowerController, error) {
+	if h.Power == nil {
+		if h.SmartPlug != "" {
+			return &ESPHome{Host: h.SmartPlug}, nil
+		}
+		if h.MAC != "" {
+			return h.wol(), nil
+		}
+		return nil, fmt.Errorf("host %q has neither power configuration, smart plug nor MAC address", h.Name)
+	}
+	switch p := h.Power; p.Type {
+	case "esphome":
+		return &ESPHome{Host: p.Host}, nil
+	case "shelly":
+		return &Shelly{Host: p.Host, Switch: p.Switch}, nil
+	case "tasmota":
+		relay := p.Switch
+		if relay == 0 {
+			relay = 1
+		}
+		return &Tasmota{Host: p.Host, Relay: relay}, nil
+	case "ipmi":
+		return &IPMI{Host: p.Host, User: p.User, PasswordFile: p.PasswordFile, Command: p.Command}, nil
+	case "mqtt":
+		return &MQTT{Broker: p.Broker, Topic: p.Topic}, nil
+	case "wol":
+		if h.MAC == "" {
+			return nil, fmt.Errorf("host %q: wol power controller requires a MAC address", h.Name)
+		}
+		return h.wol(), nil
+	default:
+		return nil, fmt.Errorf("host %q: unknown power controller type %q", h.Name, p.Type)
+	}
+}
+
+func (h Host) wol() *WOL {
+	w := &WOL{MAC: h.MAC, IP: h.IP}
+	if h.WOL != nil {
+		w.WOLConfig = *h.WOL
+	}
+	return w
+}
+
+// WOLConfig configures how Wake-on-LAN magic packets are sent. By default,
+// they are broadcast to 255.255.255.255:9 from the local 10.0.0.0/8 address.
+type WOLConfig struct {
+	// Subnet (CIDR notation, e.g. 10.11.0.0/24) selects a directed broadcast
+	// to the subnet broadcast address, sent from the local address within
+	// the subnet (if any).
+	Subnet string `json:"subnet,omitempty"`
+
+	// Unicast sends the magic packet to the host IP address instead of
+	// broadcasting it. This requires the switch and ARP caches to still know
+	// the sleeping machine.
+	Unicast bool `json:"unicast,omitempty"`
+
+	// Port is the UDP port to send to, usually 7 or 9 (default).
+	Port int `json:"port,omitempty"`
+
+	// Interface selects sending raw Ethernet frames (EtherType 0x0842) on the
+	// specified network interface instead of UDP packets.
+	Interface string `json:"interface,omitempty"`
+
+	// Password is the SecureOn password, written like a MAC address.
+	Password string `json:"password,omitempty"`
+}
+
+func (c *WOLConfig) validate() error {
+	if c.Subnet != "" {
+		ip, _, err := net.ParseCIDR(c.Subnet)
+		if err != nil {
+			return err
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("subnet %q is not an IPv4 subnet", c.Subnet)
+		}
+	}
+	if c.Subnet != "" && c.Unicast {
+		return errors.New("subnet and unicast are mutually exclusive")
+	}
+	if c.Interface != "" && (c.Subnet != "" || c.Unicast || c.Port != 0) {
+		return errors.New("interface (raw Ethernet) cannot be combined with subnet, unicast or port")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.Password != "" {
+		if _, err := wakeonlan.ParsePassword(c.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WOL wakes machines by sending a Wake-on-LAN magic packet.
+type WOL struct {
+	MAC string
+	IP  string // used for unicast
+	WOLConfig
+}
+
+func (w *WOL) String() string { return "wake-on-lan " + w.MAC }
+
+// localAddrIn returns the first local interface address within subnet.
+func localAddrIn(subnet *net.IPNet) (*net.UDPAddr, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if subnet.Contains(ipnet.IP) {
+			return &net.UDPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (w *WOL) Wake(ctx context.Context) error {
+	var password []byte
+	if w.Password != "" {
+		var err error
+		password, err = wakeonlan.ParsePassword(w.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.Interface != "" {
+		log.Printf("Sending raw magic packet to %v on %s", w.MAC, w.Interface)
+		if err := wakeonlan.SendRawMagicPacket(w.Interface, w.MAC, password); err != nil {
+			return fmt.Errorf("sendWOL: %w", err)
+		}
+		log.Printf("Sent raw magic packet to %v", w.MAC)
+		return nil
+	}
+
+	opts := wakeonlan.Options{
+		Dest:     net.IPv4bcast,
+		Port:     w.Port,
+		Password: password,
+	}
+	if opts.Port == 0 {
+		opts.Port = wakeonlan.DefaultPort
+	}
+	switch {
+	case w.Subnet != "":
+		_, subnet, err := net.ParseCIDR(w.Subnet)
+		if err != nil {
+			return err
+		}
+		opts.Dest = wakeonlan.BroadcastAddr(subnet)
+		if opts.LocalAddr, err = localAddrIn(subnet); err != nil {
+			return err
+		}
+
+	case w.Unicast:
+		opts.Dest = net.ParseIP(w.IP)
+
+	default:
+		ips, err := ifaddr.PrivateInterfaceAddrs()
+		if err != nil {
+			return err
+		}
+		_, lan, err := net.ParseCIDR("10.0.0.0/8")
+		if err != nil {
+			return err
+		}
+		for _, ipstr := range ips {
+			if ip := net.ParseIP(ipstr); lan.Contains(ip) {
+				opts.LocalAddr = &net.UDPAddr{IP: ip}
+				break
+			}
+		}
+	}
+	log.Printf("Sending magic packet to %v (dest %v, port %d)", w.MAC, opts.Dest, opts.Port)
+	if err := wakeonlan.SendMagicPacketTo(w.MAC, opts); err != nil {
+		return fmt.Errorf("sendWOL: %w", err)
+	}
+	log.Printf("Sent magic packet to %v", w.MAC)
+	return nil
+}
+
+func (w *WOL) PowerCycle(ctx context.Context) error { return ErrUnsupported }
+
+// relayPlug is a smart plug with a relay and a power sensor.
+type relayPlug interface {
+	setRelay(ctx context.Context, on bool) error
+	readPower(ctx context.Context) (float64, error)
+	String() string
+}
+
+// smartPlugMinOff is how long the relay stays off during a power cycle, on top
+// of waiting for the load sensor to drop. ATX PSU hold-up capacitors keep the
+// rails alive for a few seconds; the mainboard only sees a clean AC loss (and
+// re-fires "restore on AC power") if power stays gone long enough to drain
+// them.
+const smartPlugMinOff = 30 * time.Second
+
+// powerCycleRelay cuts smart plug relay power, waits for the load to fall
+// below 5W AND for smartPlugMinOff to elapse (so PSU capacitors drain and BIOS
+// sees a fresh AC cycle), then restores power. Used both for waking (BIOS
+// configured to "restore on AC") and for resetting a hung machine.
+func powerCycleRelay(ctx context.Context, plug relayPlug) error {
+	log.Printf("[%s] cutting smart plug relay power", plug)
+	offStart := time.Now()
+	if err := plug.setRelay(ctx, false); err != nil {
+		return fmt.Errorf("turning off relay: %w", err)
+	}
+	pollCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
+	defer canc()
+	if err := pollPowerOff(pollCtx, plug, 5); err != nil {
+		return fmt.Errorf("waiting for power off: %w", err)
+	}
+	if remaining := smartPlugMinOff - time.Since(offStart); remaining > 0 {
+		log.Printf("[%s] holding off for %v to ensure clean AC loss", plug, remaining.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(remaining):
+		}
+	}
+	log.Printf("[%s] restoring smart plug relay power", plug)
+	if err := plug.setRelay(ctx, true); err != nil {
+		return fmt.Errorf("turning on relay: %w", err)
+	}
+	return nil
+}
+
+// pollPowerOff polls the smart plug power sensor every 2s until the reading
+// drops below thresholdWatts, indicating the machine is off.
+func pollPowerOff(ctx context.Context, plug relayPlug, thresholdWatts float64) error {
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	log.Printf("[%s] polling power sensor until below %.0fW", plug, thresholdWatts)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+			watts, err := plug.readPower(ctx)
+			if err != nil {
+				log.Printf("[%s] reading power: %v", plug, err)
+				continue
+			}
+			log.Printf("[%s] power: %.1fW", plug, watts)
+			if watts < thresholdWatts {
+				log.Printf("[%s] power below %.0fW, machine is off", plug, thresholdWatts)
+				return nil
+			}
+		}
+	}
+}
+
+// httpJSON sends an HTTP request to a smart plug and decodes the JSON
+// response into v (unless v is nil).
+func httpJSON(ctx context.Context, method, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: HTTP %d", method, url, resp.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding smart plug response: %w", err)
+	}
+	return nil
+}
+
+// ESPHome controls a smart plug running ESPHome with the REST API enabled.
+// Machines behind the plug must be configured to restore on AC power, so
+// waking is a power cycle.
+type ESPHome struct {
+	Host string
+}
+
+func (e *ESPHome) String() string { return "esphome " + e.Host }
+
+func (e *ESPHome) setRelay(ctx context.Context, on bool) error {
+	action := "turn_off"
+	if on {
+		action = "turn_on"
+	}
+	return httpJSON(ctx, "POST", "http://"+e.Host+"/switch/switch/"+action, nil)
+}
+
+func (e *ESPHome) readPower(ctx context.Context) (float64, error) {
+	var result struct {
+		Value float64 `json:"value"`
+	}
+	if err := httpJSON(ctx, "GET", "http://"+e.Host+"/sensor/power", &result); err != nil {
+		return 0, err
+	}
+	return result.Value, nil
+}
+
+func (e *ESPHome) Wake(ctx context.Context) error       { return powerCycleRelay(ctx, e) }
+func (e *ESPHome) PowerCycle(ctx context.Context) error { return powerCycleRelay(ctx, e) }
+
+// Shelly controls a Shelly Gen2 (or newer) smart plug via its RPC API.
+type Shelly struct {
+	Host   string
+	Switch int
+}
+
+func (s *Shelly) String() string { return "shelly " + s.Host }
+
+func (s *Shelly) setRelay(ctx context.Context, on bool) error {
+	u := fmt.Sprintf("http://%s/rpc/Switch.Set?id=%d&on=%v", s.Host, s.Switch, on)
+	return httpJSON(ctx, "GET", u, nil)
+}
+
+func (s *Shelly) readPower(ctx context.Context) (float64, error) {
+	var result struct {
+		Apower float64 `json:"apower"`
+	}
+	u := fmt.Sprintf("http://%s/rpc/Switch.GetStatus?id=%d", s.Host, s.Switch)
+	if err := httpJSON(ctx, "GET", u, &result); err != nil {
+		return 0, err
+	}
+	return result.Apower, nil
+}
+
+func (s *Shelly) Wake(ctx context.Context) error       { return powerCycleRelay(ctx, s) }
+func (s *Shelly) PowerCycle(ctx context.Context) error { return powerCycleRelay(ctx, s) }
+
+// Tasmota controls a smart plug running Tasmota via its HTTP command API.
+type Tasmota struct {
+	Host  string
+	Relay int
+}
+
+func (t *Tasmota) String() string { return "tasmota " + t.Host }
+
+func (t *Tasmota) command(ctx context.Context, cmnd string, v any) error {
+	u := "http://" + t.Host + "/cm?cmnd=" + url.QueryEscape(cmnd)
+	return httpJSON(ctx, "GET", u, v)
+}
+
+func (t *Tasmota) setRelay(ctx context.Context, on bool) error {
+	state := "Off"
+	if on {
+		state = "On"
+	}
+	return t.command(ctx, fmt.Sprintf("Power%d %s", t.Relay, state), nil)
+}
+
+func (t *Tasmota) readPower(ctx context.Context) (float64, error) {
+	var result struct {
+		StatusSNS struct {
+			ENERGY struct {
+				Power float64 `json:"Power"`
+			} `json:"ENERGY"`
+		} `json:"StatusSNS"`
+	}
+	if err := t.command(ctx, "Status 10", &result); err != nil {
+		return 0, err
+	}
+	return result.StatusSNS.ENERGY.Power, nil
+}
+
+func (t *Tasmota) Wake(ctx context.Context) error       { return powerCycleRelay(ctx, t) }
+func (t *Tasmota) PowerCycle(ctx context.Context) error { return powerCycleRelay(ctx, t) }
+
+// IPMI controls a machine through its BMC by running ipmitool (or a local
+// stand-in program accepting the same arguments).
+type IPMI struct {
+	Host         string
+	User         string
+	PasswordFile string
+	Command      string
+}
+
+func (i *IPMI) String() string { return "ipmi " + i.Host }
+
+func (i *IPMI) chassisPower(ctx context.Context, action string) error {
+	command := i.Command
+	if command == "" {
+		command = "ipmitool"
+	}
+	args := []string{"-I", "lanplus", "-H", i.Host}
+	if i.User != "" {
+		args = append(args, "-U", i.User)
+	}
+	if i.PasswordFile != "" {
+		args = append(args, "-f", i.PasswordFile)
+	}
+	args = append(args, "chassis", "power", action)
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	log.Printf("[%s] %v", i, cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return nil
+}
+
+func (i *IPMI) Wake(ctx context.Context) error       { return i.chassisPower(ctx, "on") }
+func (i *IPMI) PowerCycle(ctx context.Context) error { return i.chassisPower(ctx, "cycle") }
+
+// MQTT publishes "wake" and "power_cycle" commands to an MQTT topic, leaving
+// the power control to whichever home automation device subscribes to it.
+type MQTT struct {
+	Broker string
+	Topic  string
+}
+
+func (m *MQTT) String() string { return "mqtt " + m.Topic }
+
+func (m *MQTT) publish(ctx context.Context, payload string) error {
+	broker := m.Broker
+	if broker == "" {
+		broker = "tcp://mqtt.lan:1883"
+	}
+	opts := mqtt.NewClientOptions().AddBroker(broker)
+	clientID := "https://github.com/stapelberg/zkj-nas-tools/wake"
+	if hostname, err := os.Hostname(); err == nil {
+		clientID += "@" + hostname
+	}
+	opts.SetClientID(clientID + "-" + strconv.FormatInt(time.Now().UnixNano(), 36))
+	cl := mqtt.NewClient(opts)
+	connect := cl.Connect()
+	defer cl.Disconnect(250)
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("MQTT connection to %s: %w", broker, ctx.Err())
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("MQTT connection to %s timed out", broker)
+	case <-connect.Done():
+	}
+	if err := connect.Error(); err != nil {
+		return fmt.Errorf("MQTT connection failed: %v", err)
+	}
+	const qosAtLeastOnce = 1
+	token := cl.Publish(m.Topic, qosAtLeastOnce, false /* retained */, payload)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-token.Done():
+	}
+	return token.Error()
+}
+
+func (m *MQTT) Wake(ctx context.Context) error       { return m.publish(ctx, "wake") }
+func (m *MQTT) PowerCycle(ctx context.Context) error { return m.publish(ctx, "power_cycle") }
@@ -0,0 +1,235 @@
+package wake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Probe is a readiness check. Once a host accepts SSH connections,
+// WakeupWithProgress runs all probes of the host in order, each as a separate
+// progress phase, and polls each probe until it succeeds.
+type Probe struct {
+	// Type is one of "tcp", "http", "ssh" or "mount".
+	Type string `json:"type"`
+
+	// Name is displayed in progress reports. Defaults to a description
+	// derived from the probe configuration.
+	Name string `json:"name,omitempty"`
+
+	// Port is the TCP port to connect to (type tcp).
+	Port int `json:"port,omitempty"`
+
+	// URL is fetched with an HTTP GET request (type http).
+	URL string `json:"url,omitempty"`
+	// Status is the expected HTTP status code (type http, default 200).
+	Status int `json:"status,omitempty"`
+
+	// Command is run via SSH (type ssh).
+	Command string `json:"command,omitempty"`
+	// ExitCode is the expected exit code of Command (type ssh, default 0).
+	ExitCode int `json:"exit_code,omitempty"`
+
+	// Path must be a mountpoint on the host (type mount). Checked via SSH.
+	Path string `json:"path,omitempty"`
+
+	// User is the SSH user (types ssh and mount, default root).
+	User string `json:"user,omitempty"`
+	// KeyFile is the path to the SSH private key (types ssh and mount).
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+func (p *Probe) validate() error {
+	switch p.Type {
+	case "tcp":
+		if p.Port <= 0 || p.Port > 65535 {
+			return fmt.Errorf("tcp probe: invalid port %d", p.Port)
+		}
+	case "http":
+		if p.URL == "" {
+			return errors.New("http probe: url is empty")
+		}
+	case "ssh":
+		if p.Command == "" {
+			return errors.New("ssh probe: command is empty")
+		}
+		if p.KeyFile == "" {
+			return errors.New("ssh probe: key_file is empty")
+		}
+	case "mount":
+		if p.Path == "" {
+			return errors.New("mount probe: path is empty")
+		}
+		if p.KeyFile == "" {
+			return errors.New("mount probe: key_file is empty")
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q", p.Type)
+	}
+	return nil
+}
+
+// String returns the probe name as displayed in progress reports.
+func (p *Probe) String() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	switch p.Type {
+	case "tcp":
+		return "tcp/" + strconv.Itoa(p.Port)
+	case "http":
+		return p.URL
+	case "ssh":
+		return "ssh " + p.Command
+	case "mount":
+		return "mount " + p.Path
+	}
+	return p.Type
+}
+
+// check runs the probe once against host.
+func (p *Probe) check(ctx context.Context, host Host) error {
+	ctx, canc := context.WithTimeout(ctx, 5*time.Second)
+	defer canc()
+	switch p.Type {
+	case "tcp":
+		return PollSSH1(ctx, net.JoinHostPort(host.IP, strconv.Itoa(p.Port)))
+	case "http":
+		status := p.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return pollHTTP1(ctx, p.URL, status)
+	case "ssh":
+		return p.checkSSH(ctx, host, p.Command, p.ExitCode)
+	case "mount":
+		return p.checkSSH(ctx, host, "mountpoint -q "+strconv.Quote(p.Path), 0)
+	}
+	return fmt.Errorf("unknown probe type %q", p.Type)
+}
+
+func pollHTTP1(ctx context.Context, url string, status int) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+	if got, want := resp.StatusCode, status; got != want {
+		return fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	return nil
+}
+
+// SSHHostKeyCallback verifies the host keys of ssh and mount readiness probes.
+// Programs which pin host keys (e.g. dornröschen) set it at startup. If nil,
+// host keys are not verified.
+var SSHHostKeyCallback ssh.HostKeyCallback
+
+// SSHHostKeyAlgorithms optionally returns the host key algorithms to accept
+// from addr, i.e. those of its pinned keys (see SSHHostKeyCallback).
+var SSHHostKeyAlgorithms func(addr string) []string
+
+// SSHAddr optionally returns the SSH address (host:port) of host, e.g. to use
+// a port other than 22. It is used to check whether host is up and for ssh and
+// mount readiness probes.
+var SSHAddr func(host Host) string
+
+func sshAddr(host Host) string {
+	if SSHAddr != nil {
+		return SSHAddr(host)
+	}
+	return net.JoinHostPort(host.IP, "22")
+}
+
+func (p *Probe) checkSSH(ctx context.Context, host Host, command string, exitCode int) error {
+	b, err := os.ReadFile(p.KeyFile)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return err
+	}
+	user := p.User
+	if user == "" {
+		user = "root"
+	}
+	addr := sshAddr(host)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	cfg := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: SSHHostKeyCallback,
+	}
+	if cfg.HostKeyCallback == nil {
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	if SSHHostKeyAlgorithms != nil {
+		cfg.HostKeyAlgorithms = SSHHostKeyAlgorithms(addr)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		return err
+	}
+	cl := ssh.NewClient(c, chans, reqs)
+	defer cl.Close()
+	session, err := cl.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	got := 0
+	if err := session.Run(command); err != nil {
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
+		}
+		got = exitErr.ExitStatus()
+	}
+	if got != exitCode {
+		return fmt.Errorf("%q: unexpected exit code: got %d, want %d", command, got, exitCode)
+	}
+	return nil
+}
+
+// PollProbe runs the probe against host once per second until it succeeds or
+// ctx is done.
+func PollProbe(ctx context.Context, host Host, p Probe) error {
+	log.Printf("[%s] polling probe %s", host.Name, p.String())
+	for {
+		time.Sleep(1 * time.Second)
+		if err := ctx.Err(); err != nil {
+			log.Printf("[%s] polling ended: %v", host.Name, err)
+			return err
+		}
+		if err := p.check(ctx, host); err != nil {
+			log.Print(err)
+			continue
+		}
+		return nil // probe succeeded
+	}
+}
@@ -2,18 +2,11 @@ package wake
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
-	"strings"
 	"time"
-
-	"github.com/gokrazy/gokrazy/ifaddr"
-	"github.com/stapelberg/zkj-nas-tools/internal/wakeonlan"
 )
 
 func PollSSH1(ctx context.Context, addr string) error {
@@ -32,7 +25,7 @@ func PollSSH(ctx context.Context, addr string) error {
 	// Do not try more than one connection attempt per second.
 	tick := time.NewTicker(1 * time.Second)
 	defer tick.Stop()
-	log.Printf("[%s] polling tcp/22 (ssh) port", addr)
+	log.Printf("[%s] polling ssh port", addr)
 	for range tick.C {
 		if err := ctx.Err(); err != nil {
 			log.Printf("[%s] polling ended: %v", addr, err)
@@ -42,151 +35,48 @@ func PollSSH(ctx context.Context, addr string) error {
 			log.Print(err)
 			continue
 		}
-		return nil // port 22 became reachable
-	}
-	return nil
-}
-
-func pollHTTPHealthz1(ctx context.Context, addr string) error {
-	ctx, canc := context.WithTimeout(ctx, 5*time.Second)
-	defer canc()
-	req, err := http.NewRequest("GET", "http://"+addr, nil)
-	if err != nil {
-		return err
-	}
-	req = req.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		io.ReadAll(resp.Body)
-		resp.Body.Close()
-	}()
-	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		return fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+		return nil // ssh port became reachable
 	}
 	return nil
 }
 
-func PollHTTPHealthz(ctx context.Context, addr string) error {
-	log.Printf("[%s] polling http/8200 (healthz) port", addr)
-	for {
-		time.Sleep(1 * time.Second)
-		if err := ctx.Err(); err != nil {
-			log.Printf("[%s] polling ended: %v", addr, err)
-			return err
-		}
-		if err := pollHTTPHealthz1(ctx, addr); err != nil {
-			log.Print(err)
-			continue
-		}
-		return nil // addr returned HTTP 200
-	}
-}
-
-type Host struct {
-	Name          string
-	IP            string
-	MAC           string
-	Relay         string // webwake instance
-	UnlockCommand string
-	SmartPlug     string // ESPHome smart plug hostname for power control
-}
-
-var Hosts = map[string]Host{
-	"midna": {
-		Name:  "midna",
-		IP:    "10.0.0.76", // static lease
-		MAC:   "bc:fc:e7:68:12:0e",
-		Relay: "router7",
-	},
-	"mixna": {
-		Name:          "mixna",
-		IP:            "10.0.0.47", // static lease
-		MAC:           "04:42:1a:31:9e:97",
-		Relay:         "router7",
-		UnlockCommand: "systemctl default",
-	},
-	"storage2": {
-		Name: "storage2",
-		IP:   "10.0.0.252",
-		// No MAC, woken up via smart plug (BIOS: restore on AC power).
-		Relay:     "router7",
-		SmartPlug: "smartplug-5759d6.lan",
-	},
-	"storage3": {
-		Name:      "storage3",
-		IP:        "10.0.0.253",
-		MAC:       "70:85:c2:8d:b9:76",
-		Relay:     "router7",
-		SmartPlug: "plug-storage3.lan",
-	},
-	"verkaufg9": {
-		Name:          "verkaufg9",
-		IP:            "10.11.0.2",
-		MAC:           "7c:4d:8f:00:67:0a",
-		Relay:         "blr",
-		UnlockCommand: "cryptroot-unlock",
-	},
-}
-
 type Config struct {
 	Target Host
 }
 
-// The wake tool is invoked using speaking names (storage2, storage3), whereas
-// dornroeschen uses the IP address as name. This function identifies storage
-// targets using name or IP.
-func (c *Config) isStorage() bool {
-	return strings.HasPrefix(c.Target.Name, "storage") ||
-		c.Target.IP == "10.0.0.252" ||
-		c.Target.IP == "10.0.0.253"
-}
-
 var ErrAlreadyRunning = errors.New("already running")
 
-// SendWakeSignal sends the wake signal (smart plug or WoL) without any polling.
-// This is an atomic building block for CLI orchestration.
+// SendWakeSignal wakes the target via its PowerController (e.g. smart plug or
+// WoL) without any polling. This is an atomic building block for CLI
+// orchestration.
 func (c *Config) SendWakeSignal(ctx context.Context) error {
-	if c.Target.SmartPlug != "" {
-		log.Printf("power-cycling smart plug %s for %s", c.Target.SmartPlug, c.Target.Name)
-		return PowerCycleSmartPlug(ctx, c.Target.SmartPlug)
-	}
+	_, err := c.sendWakeSignal(ctx)
+	return err
+}
 
-	log.Printf("Sending magic packet to %v", c.Target.MAC)
-	ips, err := ifaddr.PrivateInterfaceAddrs()
+func (c *Config) sendWakeSignal(ctx context.Context) (PowerController, error) {
+	pc, err := c.Target.PowerController()
 	if err != nil {
-		return err
-	}
-	var laddr *net.UDPAddr
-	_, lan, err := net.ParseCIDR("10.0.0.0/8")
-	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, ipstr := range ips {
-		if ip := net.ParseIP(ipstr); lan.Contains(ip) {
-			laddr = &net.UDPAddr{IP: ip}
-			break
-		}
-	}
-	if err := wakeonlan.SendMagicPacket(laddr, c.Target.MAC); err != nil {
-		return fmt.Errorf("sendWOL: %w", err)
-	}
-	log.Printf("Sent magic packet to %v", c.Target.MAC)
-	return nil
+	log.Printf("waking %s via %s", c.Target.Name, pc)
+	return pc, pc.Wake(ctx)
 }
 
 // ProgressFunc is called to report progress during wakeup.
-// phase is one of: "checking", "waking", "ssh", "health", "complete"
+// phase is one of: "checking", "waking", "ssh", "health/<probe>", "complete"
 // status is one of: "start", "done", "skipped", "error", "already_running"
 type ProgressFunc func(phase, status, detail string)
 
+// ProbePhasePrefix prefixes the progress phase names of readiness probes,
+// e.g. "health/mount /srv".
+const ProbePhasePrefix = "health/"
+
 // Wakeup wakes up the specified host unless it is already running.
-// A host is considered up when it accepts SSH connections (tcp/22).
-//
-// For hosts storage*, HTTP on port 8200 needs to return HTTP 200, too,
-// signaling that the /srv mountpoint was successfully mounted.
+// A host is considered up when it accepts SSH connections (tcp/22 unless
+// overridden by SSHAddr) and all of its readiness probes succeed (e.g. HTTP on
+// port 8200 returning HTTP 200, signaling that the /srv mountpoint was
+// successfully mounted).
 func (c *Config) Wakeup(ctx context.Context) error {
 	return c.WakeupWithProgress(ctx, nil)
 }
@@ -197,26 +87,20 @@ func (c *Config) WakeupWithProgress(ctx context.Context, progressFn ProgressFunc
 		progressFn = func(phase, status, detail string) {}
 	}
 
+	addr := sshAddr(c.Target)
+
 	// Phase: checking
-	progressFn("checking", "start", fmt.Sprintf("checking tcp/22 on %s", c.Target.Name))
+	progressFn("checking", "start", fmt.Sprintf("checking ssh (%s) on %s", addr, c.Target.Name))
 	{
-		log.Printf("checking if tcp/22 (ssh) is available on %s", c.Target.Name)
+		log.Printf("checking if ssh (%s) is available on %s", addr, c.Target.Name)
 		checkCtx, canc := context.WithTimeout(ctx, 5*time.Second)
 		defer canc()
-		if err := PollSSH1(checkCtx, c.Target.IP+":22"); err == nil {
+		if err := PollSSH1(checkCtx, addr); err == nil {
 			log.Printf("SSH already up and running")
 			progressFn("checking", "done", "already running")
 
-			if c.isStorage() {
-				progressFn("health", "start", "checking /srv mount")
-				healthCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
-				defer canc()
-				if err := PollHTTPHealthz(healthCtx, c.Target.IP+":8200"); err != nil {
-					progressFn("health", "error", err.Error())
-					return err
-				}
-				log.Printf("host %s signals /srv is mounted", c.Target.Name)
-				progressFn("health", "done", "/srv mounted")
+			if err := c.runProbes(ctx, progressFn); err != nil {
+				return err
 			}
 
 			progressFn("complete", "already_running", "")
@@ -227,22 +111,19 @@ func (c *Config) WakeupWithProgress(ctx context.Context, progressFn ProgressFunc
 
 	// Phase: waking
 	progressFn("waking", "start", "sending wake signal")
-	if err := c.SendWakeSignal(ctx); err != nil {
+	pc, err := c.sendWakeSignal(ctx)
+	if err != nil {
 		progressFn("waking", "error", err.Error())
 		return err
 	}
-	detail := "sent magic packet"
-	if c.Target.SmartPlug != "" {
-		detail = "power-cycled smart plug"
-	}
-	progressFn("waking", "done", detail)
+	progressFn("waking", "done", "woken via "+pc.String())
 
 	// Phase: ssh
-	progressFn("ssh", "start", "polling tcp/22")
+	progressFn("ssh", "start", "polling "+addr)
 	{
 		sshCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
 		defer canc()
-		if err := PollSSH(sshCtx, c.Target.IP+":22"); err != nil {
+		if err := PollSSH(sshCtx, addr); err != nil {
 			progressFn("ssh", "error", err.Error())
 			return err
 		}
@@ -250,127 +131,30 @@ func (c *Config) WakeupWithProgress(ctx context.Context, progressFn ProgressFunc
 		progressFn("ssh", "done", "ssh responding")
 	}
 
-	// Phase: health
-	if c.isStorage() {
-		progressFn("health", "start", "checking /srv mount")
-		healthCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
-		defer canc()
-		if err := PollHTTPHealthz(healthCtx, c.Target.IP+":8200"); err != nil {
-			progressFn("health", "error", err.Error())
-			return err
-		}
-		log.Printf("host %s signals /srv is mounted", c.Target.Name)
-		progressFn("health", "done", "/srv mounted")
-	} else {
-		progressFn("health", "skipped", "")
+	// Phases: health/<probe>
+	if err := c.runProbes(ctx, progressFn); err != nil {
+		return err
 	}
 
 	progressFn("complete", "done", "")
 	return nil
 }
 
-// readSmartPlugPower reads the current power consumption in watts from an
-// ESPHome smart plug's REST API.
-func readSmartPlugPower(ctx context.Context, plugHost string) (float64, error) {
-	url := "http://" + plugHost + "/sensor/power"
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return 0, err
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("smart plug %s returned HTTP %d", plugHost, resp.StatusCode)
-	}
-	var result struct {
-		Value float64 `json:"value"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, fmt.Errorf("decoding smart plug response: %w", err)
-	}
-	return result.Value, nil
-}
-
-// SetSmartPlugRelay controls the relay on an ESPHome smart plug.
-// action must be "turn_on" or "turn_off".
-func SetSmartPlugRelay(ctx context.Context, plugHost, action string) error {
-	url := "http://" + plugHost + "/switch/switch/" + action
-	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("smart plug %s returned HTTP %d for %s", plugHost, resp.StatusCode, action)
-	}
-	return nil
-}
-
-// smartPlugMinOff is how long the relay stays off during a power cycle, on top
-// of waiting for the load sensor to drop. ATX PSU hold-up capacitors keep the
-// rails alive for a few seconds; the mainboard only sees a clean AC loss (and
-// re-fires "restore on AC power") if power stays gone long enough to drain
-// them.
-const smartPlugMinOff = 30 * time.Second
-
-// PowerCycleSmartPlug cuts smart plug relay power, waits for the load to fall
-// below 5W AND for smartPlugMinOff to elapse (so PSU capacitors drain and BIOS
-// sees a fresh AC cycle), then restores power. Used both for waking (BIOS
-// configured to "restore on AC") and for resetting a hung machine.
-func PowerCycleSmartPlug(ctx context.Context, plugHost string) error {
-	log.Printf("[%s] cutting smart plug relay power", plugHost)
-	offStart := time.Now()
-	if err := SetSmartPlugRelay(ctx, plugHost, "turn_off"); err != nil {
-		return fmt.Errorf("turning off relay: %w", err)
-	}
-	pollCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
-	defer canc()
-	if err := PollSmartPlugPowerOff(pollCtx, plugHost, 5); err != nil {
-		return fmt.Errorf("waiting for power off: %w", err)
-	}
-	if remaining := smartPlugMinOff - time.Since(offStart); remaining > 0 {
-		log.Printf("[%s] holding off for %v to ensure clean AC loss", plugHost, remaining.Round(time.Millisecond))
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(remaining):
+// runProbes runs the readiness probes of the target in order, reporting each
+// probe as a separate progress phase.
+func (c *Config) runProbes(ctx context.Context, progressFn ProgressFunc) error {
+	for _, p := range c.Target.Readiness {
+		phase := ProbePhasePrefix + p.String()
+		progressFn(phase, "start", "polling "+p.Type+" probe")
+		probeCtx, canc := context.WithTimeout(ctx, 5*time.Minute)
+		err := PollProbe(probeCtx, c.Target, p)
+		canc()
+		if err != nil {
+			progressFn(phase, "error", err.Error())
+			return err
 		}
-	}
-	log.Printf("[%s] restoring smart plug relay power", plugHost)
-	if err := SetSmartPlugRelay(ctx, plugHost, "turn_on"); err != nil {
-		return fmt.Errorf("turning on relay: %w", err)
+		log.Printf("host %s: probe %s succeeded", c.Target.Name, p.String())
+		progressFn(phase, "done", "ready")
 	}
 	return nil
 }
-
-// PollSmartPlugPowerOff polls the smart plug power sensor every 2s until the
-// reading drops below thresholdWatts, indicating the machine is off.
-func PollSmartPlugPowerOff(ctx context.Context, plugHost string, thresholdWatts float64) error {
-	tick := time.NewTicker(2 * time.Second)
-	defer tick.Stop()
-	log.Printf("[%s] polling power sensor until below %.0fW", plugHost, thresholdWatts)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-tick.C:
-			watts, err := readSmartPlugPower(ctx, plugHost)
-			if err != nil {
-				log.Printf("[%s] reading power: %v", plugHost, err)
-				continue
-			}
-			log.Printf("[%s] power: %.1fW", plugHost, watts)
-			if watts < thresholdWatts {
-				log.Printf("[%s] power below %.0fW, machine is off", plugHost, thresholdWatts)
-				return nil
-			}
-		}
-	}
-}
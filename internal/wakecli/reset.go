@@ -2,6 +2,7 @@ package wakecli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -14,8 +15,8 @@ import (
 
 var resetCmd = &cobra.Command{
 	Use:          "reset <hostname>",
-	Short:        "Reset a machine via smart plug power cycle",
-	Long:         `Reset a machine by first shutting it down via SSH with the ~/.ssh/id_poweroff key, then cutting smart plug relay power, waiting for power to drop, and restoring relay power so WOL works again. Use --force to skip the SSH shutdown.`,
+	Short:        "Reset a machine via power cycle",
+	Long:         `Reset a machine by first shutting it down via SSH with the ~/.ssh/id_poweroff key, then power-cycling it via its power controller (e.g. cutting smart plug relay power, waiting for power to drop, and restoring relay power so WOL works again). Use --force to skip the SSH shutdown.`,
 	Args:         cobra.ExactArgs(1),
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -24,8 +25,9 @@ var resetCmd = &cobra.Command{
 			return err
 		}
 
-		if host.SmartPlug == "" {
-			return fmt.Errorf("host %q has no smart plug configured", host.Name)
+		pc, err := host.PowerController()
+		if err != nil {
+			return err
 		}
 
 		force, err := cmd.Flags().GetBool("force")
@@ -40,8 +42,11 @@ var resetCmd = &cobra.Command{
 			return nil
 		}
 
-		log.Printf("power-cycling %s via smart plug %s", host.Name, host.SmartPlug)
-		if err := wake.PowerCycleSmartPlug(cmd.Context(), host.SmartPlug); err != nil {
+		log.Printf("power-cycling %s via %s", host.Name, pc)
+		if err := pc.PowerCycle(cmd.Context()); err != nil {
+			if errors.Is(err, wake.ErrUnsupported) {
+				return fmt.Errorf("host %q cannot be reset: %s does not support power cycling", host.Name, pc)
+			}
 			return err
 		}
 		log.Printf("reset of %s complete", host.Name)
@@ -50,7 +55,7 @@ var resetCmd = &cobra.Command{
 }
 
 func init() {
-	resetCmd.Flags().Bool("force", false, "skip SSH shutdown, cut relay power immediately")
+	resetCmd.Flags().Bool("force", false, "skip SSH shutdown, power-cycle immediately")
 }
 
 func sshShutdown(ctx context.Context, host wake.Host) error {
@@ -3,8 +3,8 @@ package wakecli
 import (
 	"context"
 	"fmt"
-	"maps"
-	"slices"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -15,9 +15,28 @@ var rootCmd = &cobra.Command{
 	Use:   "wake",
 	Short: "Control machine power states",
 	Long:  `wake is a CLI for waking, suspending, and unlocking machines.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		hostsFile, err := cmd.Flags().GetString("hosts")
+		if err != nil {
+			return err
+		}
+		if err := wake.LoadHosts(hostsFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	},
+}
+
+func defaultHostsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "wake", "hosts.json")
 }
 
 func init() {
+	rootCmd.PersistentFlags().String("hosts", defaultHostsFile(), "host inventory file (JSON); the built-in inventory is used if it does not exist")
 	rootCmd.AddCommand(upCmd)
 	rootCmd.AddCommand(suspendCmd)
 	rootCmd.AddCommand(unlockCmd)
@@ -29,9 +48,9 @@ func Execute(ctx context.Context) error {
 }
 
 func lookupHost(hostname string) (wake.Host, error) {
-	host, ok := wake.Hosts[hostname]
+	host, ok := wake.LookupHost(hostname)
 	if !ok {
-		validHostnames := strings.Join(slices.Sorted(maps.Keys(wake.Hosts)), ", ")
+		validHostnames := strings.Join(wake.HostNames(), ", ")
 		return wake.Host{}, fmt.Errorf("unknown host %q, valid hosts: %s", hostname, validHostnames)
 	}
 	return host, nil
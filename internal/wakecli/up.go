@@ -20,7 +20,7 @@ import (
 var upCmd = &cobra.Command{
 	Use:          "up <hostname>",
 	Short:        "Wake up a machine",
-	Long:         `Wake up a machine using Wake-on-LAN or MQTT relay.`,
+	Long:         `Wake up a machine via its relay (webwake instance) or, for machines without a relay, directly via its power controller.`,
 	Args:         cobra.ExactArgs(1),
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -28,7 +28,7 @@ var upCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		return wakeUp(host)
+		return wakeUp(cmd.Context(), host)
 	},
 }
 
@@ -42,7 +42,7 @@ type ProgressEvent struct {
 
 // Phase represents a wake phase with its display state.
 type Phase struct {
-	Name    string // "checking", "waking", "ssh", "health", "complete"
+	Name    string // "checking", "waking", "ssh", "health/<probe>", "complete"
 	Label   string
 	Status  string // "start", "done", "skipped", "error", "already_running"
 	Detail  string
@@ -53,7 +53,15 @@ var phases = []Phase{
 	{Name: "checking", Label: "Checking"},
 	{Name: "waking", Label: "Waking"},
 	{Name: "ssh", Label: "Waiting for SSH"},
-	{Name: "health", Label: "Health check"},
+}
+
+// probePhase returns the display phase for a readiness probe phase reported
+// by the relay (see wake.ProbePhasePrefix).
+func probePhase(name string) Phase {
+	return Phase{
+		Name:  name,
+		Label: "Health: " + strings.TrimPrefix(name, wake.ProbePhasePrefix),
+	}
 }
 
 // encryptedPhases are used for LUKS-encrypted hosts that need interactive unlock.
@@ -150,13 +158,49 @@ func clearLines(n int) {
 	}
 }
 
-func wakeUp(target wake.Host) error {
+func wakeUp(ctx context.Context, target wake.Host) error {
 	if target.Name == "verkaufg9" {
 		return wakeUpWithUnlock(target)
 	}
+	if target.Relay == "" {
+		return wakeUpLocal(ctx, target)
+	}
 	return wakeUpStream(target)
 }
 
+// wakeUpLocal wakes up hosts without a relay directly from this machine, using
+// the same wake.Config (and hence PowerController) that webwake uses.
+func wakeUpLocal(ctx context.Context, target wake.Host) error {
+	events := make(chan ProgressEvent)
+	done := make(chan error, 1)
+
+	go func() {
+		startTime := time.Now()
+		phaseStart := time.Now()
+		sendEvent := func(event ProgressEvent) {
+			if event.Status == "start" {
+				phaseStart = time.Now() // reset for newly starting phase
+			} else {
+				event.ElapsedMs = time.Since(phaseStart).Milliseconds()
+			}
+			if event.Phase == "complete" {
+				event.ElapsedMs = time.Since(startTime).Milliseconds()
+			}
+			events <- event
+		}
+		cfg := wake.Config{Target: target}
+		err := cfg.WakeupWithProgress(ctx, func(phase, status, detail string) {
+			sendEvent(ProgressEvent{Phase: phase, Status: status, Detail: detail})
+		})
+		if err != nil && err != wake.ErrAlreadyRunning {
+			sendEvent(ProgressEvent{Phase: "complete", Status: "error", Detail: err.Error()})
+		}
+		done <- nil
+	}()
+
+	return renderProgress(target.Name, events, done)
+}
+
 func wakeUpStream(target wake.Host) error {
 	wakeURL := "http://" + target.Relay + ":8911/wake/stream?machine=" + target.Name
 
@@ -170,17 +214,6 @@ func wakeUpStream(target wake.Host) error {
 		return fmt.Errorf("server returned %v", resp.Status)
 	}
 
-	phasesCopy := slices.Clone(phases)
-	startTime := time.Now()
-	spinnerFrame := 0
-
-	output := render(target.Name, phasesCopy, spinnerFrame, 0, false)
-	printedLines := strings.Count(output, "\n")
-	fmt.Print(output)
-
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
 	events := make(chan ProgressEvent)
 	done := make(chan error, 1)
 
@@ -202,15 +235,36 @@ func wakeUpStream(target wake.Host) error {
 		done <- scanner.Err()
 	}()
 
+	return renderProgress(target.Name, events, done)
+}
+
+// renderProgress renders events until the complete phase is reached or done
+// delivers an error.
+func renderProgress(target string, events <-chan ProgressEvent, done <-chan error) error {
+	phasesCopy := slices.Clone(phases)
+	startTime := time.Now()
+	spinnerFrame := 0
+
+	output := render(target, phasesCopy, spinnerFrame, 0, false)
+	printedLines := strings.Count(output, "\n")
+	fmt.Print(output)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
 	rerender := func(dur time.Duration) {
 		clearLines(printedLines)
-		output := render(target.Name, phasesCopy, spinnerFrame, dur, true)
+		output := render(target, phasesCopy, spinnerFrame, dur, true)
 		printedLines = strings.Count(output, "\n")
 		fmt.Print(output)
 	}
 	for {
 		select {
 		case event := <-events:
+			if strings.HasPrefix(event.Phase, wake.ProbePhasePrefix) &&
+				!slices.ContainsFunc(phasesCopy, func(p Phase) bool { return p.Name == event.Phase }) {
+				phasesCopy = append(phasesCopy, probePhase(event.Phase))
+			}
 			for i := range phasesCopy {
 				if phasesCopy[i].Name != event.Phase {
 					continue
@@ -0,0 +1,41 @@
+package wakeonlan
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// SendRawMagicPacket sends the magic packet as a raw Ethernet frame with
+// EtherType 0x0842 on the specified network interface. This requires
+// CAP_NET_RAW, but works without an IP address on the target network.
+func SendRawMagicPacket(ifname, mac string, password []byte) error {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	payload, err := MagicPacket(mac, password)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(EtherType)))
+	if err != nil {
+		return fmt.Errorf("socket(AF_PACKET): %v", err)
+	}
+	defer unix.Close(fd)
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(EtherType),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := unix.Sendto(fd, payload, 0, addr); err != nil {
+		return fmt.Errorf("sendto(%s): %v", ifname, err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wakeonlan
+
+import "errors"
+
+// SendRawMagicPacket is only implemented on Linux.
+func SendRawMagicPacket(ifname, mac string, password []byte) error {
+	return errors.New("raw Ethernet magic packets are only supported on Linux")
+}
@@ -8,30 +8,115 @@ import (
 	"net"
 )
 
+// EtherType is the EtherType of raw Ethernet Wake-on-LAN frames.
+const EtherType = 0x0842
+
+// DefaultPort is the UDP port to which magic packets are sent by default
+// (discard). Some network cards listen on port 7 (echo) instead.
+const DefaultPort = 9
+
+func parseMAC(mac string) (net.HardwareAddr, error) {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(hwaddr), 6; got != want {
+		return nil, fmt.Errorf("unexpected number of parts in hardware address %q: got %d, want %d", mac, got, want)
+	}
+	return hwaddr, nil
+}
+
+// ParsePassword parses a SecureOn password, which is written like an ethernet
+// MAC address (e.g. 01:02:03:04:05:06).
+func ParsePassword(password string) ([]byte, error) {
+	b, err := parseMAC(password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SecureOn password: %v", err)
+	}
+	return b, nil
+}
+
+// MagicPacket returns the magic packet payload for the specified MAC address,
+// followed by the 6-byte SecureOn password (if any).
+func MagicPacket(mac string, password []byte) ([]byte, error) {
+	hwaddr, err := parseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) != 0 && len(password) != 6 {
+		return nil, fmt.Errorf("SecureOn password must be 6 bytes, got %d", len(password))
+	}
+	// https://en.wikipedia.org/wiki/Wake-on-LAN#Magic_packet
+	payload := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hwaddr, 16)...)
+	return append(payload, password...), nil
+}
+
+// BroadcastAddr returns the directed broadcast address of the specified IPv4
+// subnet, e.g. 10.11.0.255 for 10.11.0.0/24.
+func BroadcastAddr(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.To4()
+	mask := subnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range bcast {
+		bcast[i] = ip[i] | ^mask[i]
+	}
+	return bcast
+}
+
+// Options configures how SendMagicPacketTo sends the magic packet.
+type Options struct {
+	// LocalAddr is the local address to send from. If nil, the kernel picks an
+	// address based on the routing table.
+	LocalAddr *net.UDPAddr
+
+	// Dest is the address to send to: the limited broadcast address
+	// 255.255.255.255 (default), a directed subnet broadcast address (see
+	// BroadcastAddr) or the unicast address of the target machine.
+	Dest net.IP
+
+	// Port is the UDP port to send to (default DefaultPort).
+	Port int
+
+	// Password is the optional 6-byte SecureOn password.
+	Password []byte
+}
+
 // SendMagicPacket sends the magic Wake On LAN packet to the specified MAC
 // address, which is expected to be an ethernet MAC address
 // (e.g. b0:6e:bf:30:70:3a).
 func SendMagicPacket(localAddr *net.UDPAddr, mac string) error {
-	hwaddr, err := net.ParseMAC(mac)
+	return SendMagicPacketTo(mac, Options{LocalAddr: localAddr})
+}
+
+// SendMagicPacketTo is like SendMagicPacket, but sends the magic packet as
+// configured in opts.
+func SendMagicPacketTo(mac string, opts Options) error {
+	payload, err := MagicPacket(mac, opts.Password)
 	if err != nil {
 		return err
 	}
-	if got, want := len(hwaddr), 6; got != want {
-		return fmt.Errorf("unexpected number of parts in hardware address %q: got %d, want %d", mac, got, want)
+	dest := opts.Dest
+	if dest == nil {
+		dest = net.IPv4bcast
+	}
+	port := opts.Port
+	if port == 0 {
+		port = DefaultPort
 	}
-
 	socket, err := net.DialUDP("udp4",
-		localAddr,
+		opts.LocalAddr,
 		&net.UDPAddr{
-			IP:   net.IPv4bcast,
-			Port: 9, // discard
+			IP:   dest,
+			Port: port,
 		})
 	if err != nil {
-		return fmt.Errorf("DialUDP(broadcast:discard): %v", err)
+		return fmt.Errorf("DialUDP(%v:%d): %v", dest, port, err)
 	}
-	// https://en.wikipedia.org/wiki/Wake-on-LAN#Magic_packet
-	payload := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hwaddr, 16)...)
 	if _, err := socket.Write(payload); err != nil {
+		socket.Close()
 		return err
 	}
 	return socket.Close()
@@ -0,0 +1,120 @@
+package wakeonlan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// goldenPacket is the magic packet for 70:85:c2:8d:b9:76.
+var goldenPacket = []byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+	0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76, 0x70, 0x85, 0xc2, 0x8d, 0xb9, 0x76,
+}
+
+const goldenMAC = "70:85:c2:8d:b9:76"
+
+func TestMagicPacket(t *testing.T) {
+	got, err := MagicPacket(goldenMAC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, goldenPacket) {
+		t.Errorf("MagicPacket(%q) = %x, want %x", goldenMAC, got, goldenPacket)
+	}
+}
+
+func TestMagicPacketPassword(t *testing.T) {
+	password, err := ParsePassword("01:02:03:04:05:06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := MagicPacket(goldenMAC, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, goldenPacket...), 1, 2, 3, 4, 5, 6)
+	if !bytes.Equal(got, want) {
+		t.Errorf("MagicPacket(%q, %x) = %x, want %x", goldenMAC, password, got, want)
+	}
+
+	if _, err := MagicPacket(goldenMAC, []byte{1, 2, 3}); err == nil {
+		t.Errorf("MagicPacket with 3-byte password unexpectedly succeeded")
+	}
+}
+
+func TestMagicPacketInvalidMAC(t *testing.T) {
+	for _, mac := range []string{
+		"",
+		"not a mac",
+		"00:00:5e:00:53:01:02:03", // EUI-64
+	} {
+		if _, err := MagicPacket(mac, nil); err == nil {
+			t.Errorf("MagicPacket(%q) unexpectedly succeeded", mac)
+		}
+	}
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	for _, tt := range []struct {
+		subnet string
+		want   string
+	}{
+		{"10.11.0.0/24", "10.11.0.255"},
+		{"10.0.0.0/8", "10.255.255.255"},
+		{"192.168.1.128/25", "192.168.1.255"},
+		{"10.0.0.76/32", "10.0.0.76"},
+	} {
+		_, subnet, err := net.ParseCIDR(tt.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := BroadcastAddr(subnet); got.String() != tt.want {
+			t.Errorf("BroadcastAddr(%s) = %v, want %v", tt.subnet, got, tt.want)
+		}
+	}
+}
+
+// TestSendMagicPacketTo captures the magic packet with a local UDP listener.
+func TestSendMagicPacketTo(t *testing.T) {
+	ln, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	laddr := ln.LocalAddr().(*net.UDPAddr)
+
+	password := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	if err := SendMagicPacketTo(goldenMAC, Options{
+		Dest:     laddr.IP,
+		Port:     laddr.Port,
+		Password: password,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := ln.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf[:n]
+	if got, want := len(got), 6+16*6+6; got != want {
+		t.Fatalf("unexpected payload length: got %d, want %d", got, want)
+	}
+	if !bytes.Equal(got[:len(goldenPacket)], goldenPacket) {
+		t.Errorf("unexpected magic packet: got %x, want %x", got[:len(goldenPacket)], goldenPacket)
+	}
+	if !bytes.Equal(got[len(goldenPacket):], password) {
+		t.Errorf("unexpected SecureOn password: got %x, want %x", got[len(goldenPacket):], password)
+	}
+}
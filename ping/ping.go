@@ -1,4 +1,4 @@
-// Provides IPv4 ICMP echo round trip time measurements (“ping”).
+// Provides IPv4 and IPv6 ICMP echo round trip time measurements (“ping”).
 package ping
 
 // This code is mostly copied from go/src/pkg/net/ipraw_test.go,
@@ -41,10 +41,6 @@ import (
 	"net"
 	"os"
 	"time"
-
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -148,6 +144,9 @@ func (p *icmpEcho) Marshal() ([]byte, error) {
 // body.
 func parseICMPEcho(b []byte) (*icmpEcho, error) {
 	bodylen := len(b)
+	if bodylen < 4 {
+		return nil, errors.New("echo message body too short")
+	}
 	p := &icmpEcho{ID: int(b[0])<<8 | int(b[1]), Seq: int(b[2])<<8 | int(b[3])}
 	if bodylen > 4 {
 		p.Data = make([]byte, bodylen-4)
@@ -161,136 +160,50 @@ func ipv4Payload(b []byte) []byte {
 		return b
 	}
 	hdrlen := int(b[0]&0x0f) << 2
+	if hdrlen > len(b) {
+		return b
+	}
 	return b[hdrlen:]
 }
 
+// Ping sends one ICMP echo request to addr over a raw socket and sends the
+// round trip time (or nil if no reply arrived within timeout) to result.
+//
+// Deprecated: use Pinger, which supports cancellation and returns errors.
 func Ping(addr string, timeout time.Duration, result chan *time.Duration) {
-	conn, err := net.Dial("ip4:icmp", addr)
+	p := Pinger{Timeout: timeout, Privileged: true}
+	stats, err := p.Ping(context.Background(), addr)
 	if err != nil {
-		log.Print(err)
+		log.Printf("[ping %s] %v", addr, err)
 		result <- nil
 		return
 	}
-	defer conn.Close()
-	start := time.Now()
-	conn.SetDeadline(time.Now().Add(timeout))
-
-	xid, xseq := os.Getpid()&0xffff, 1
-	b, err := (&icmpMessage{
-		Type: icmpv4EchoRequest, Code: 0,
-		Body: &icmpEcho{
-			ID: xid, Seq: xseq,
-			Data: bytes.Repeat([]byte("Go Go Gadget Ping!!!"), 3),
-		},
-	}).Marshal()
-	if err != nil {
-		log.Fatalf("icmpMessage.Marshal failed: %v", err)
-	}
-	if _, err := conn.Write(b); err != nil {
-		log.Fatalf("Conn.Write failed: %v", err)
-	}
-	var m *icmpMessage
-	for {
-		if _, err := conn.Read(b); err != nil {
-			result <- nil
-			return
-		}
-		b = ipv4Payload(b)
-
-		if m, err = parseICMPMessage(b); err != nil {
-			log.Fatalf("[ping %s] parseICMPMessage failed: %v", addr, err)
-		}
-		switch p := m.Body.(type) {
-		case *icmpEcho:
-			if p.ID != xid || p.Seq != xseq {
-				// This can happen when somebody else is also sending ICMP echo
-				// requests — replies are sent to all the open sockets, so we
-				// get replies for other programs, too. Skip this reply and
-				// wait until either the right reply arrives or we run into the
-				// timeout.
-				continue
-			}
-			duration := time.Since(start)
-			result <- &duration
-			return
-		default:
-			log.Printf("[ping %s] got type=%v, code=%v; expected type=%v, code=%v", addr, m.Type, m.Code, icmpv4EchoRequest, 0)
-			// In case the target answered with an ICMP reply that is not ICMP
-			// echo, we skip it and either receive a proper reply later (in
-			// which case the other ICMP message was not a reply for us) or run
-			// into the timeout.
-			continue
-		}
+	if stats.Received == 0 {
+		result <- nil
+		return
 	}
+	result <- &stats.RTTs[0]
 }
 
-var seq uint // TODO: atomic
-
+// PingUnprivileged sends one ICMP echo request to host over the shared
+// unprivileged ICMP socket and returns the round trip time.
 func PingUnprivileged(ctx context.Context, host string) (time.Duration, error) {
-	const protocol = 1 // iana.ProtocolICMP
-	c, err := icmp.ListenPacket("udp4", "0.0.0.0")
-	if err != nil {
-		return 0, err
-	}
-	defer c.Close()
-
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return 0, err
-	}
-	if len(ips) == 0 {
-		return 0, fmt.Errorf("Lookup(%v) = no IPs", host)
-	}
-	addr := &net.UDPAddr{IP: ips[0]}
-
-	m := icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
-		Body: &icmp.Echo{
-			ID:   os.Getpid() & 0xffff,
-			Data: []byte("HELLO-R-U-THERE"),
-			Seq:  1 << uint(seq), // TODO: atomic
-		},
-	}
-	seq++ // TODO: atomic
-
-	wb, err := m.Marshal(nil)
-	if err != nil {
-		return 0, err
-	}
-	if n, err := c.WriteTo(wb, addr); err != nil {
-		return 0, err
-	} else if n != len(wb) {
-		return 0, fmt.Errorf("got %v; want %v", n, len(wb))
-	}
-
-	start := time.Now()
-	rb := make([]byte, 1500)
+	timeout := 5 * time.Second
 	if deadline, ok := ctx.Deadline(); ok {
-		if err := c.SetReadDeadline(deadline); err != nil {
-			return 0, err
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
 		}
 	}
-
-	n, peer, err := c.ReadFrom(rb)
-	if err != nil {
-		return 0, err
-	}
-	rm, err := icmp.ParseMessage(protocol, rb[:n])
+	p := Pinger{Timeout: timeout}
+	stats, err := p.Ping(ctx, host)
 	if err != nil {
 		return 0, err
 	}
-	switch {
-	case m.Type == ipv4.ICMPTypeEcho && rm.Type == ipv4.ICMPTypeEchoReply:
-		fallthrough
-	case m.Type == ipv6.ICMPTypeEchoRequest && rm.Type == ipv6.ICMPTypeEchoReply:
-		fallthrough
-	case m.Type == ipv4.ICMPTypeExtendedEchoRequest && rm.Type == ipv4.ICMPTypeExtendedEchoReply:
-		fallthrough
-	case m.Type == ipv6.ICMPTypeExtendedEchoRequest && rm.Type == ipv6.ICMPTypeExtendedEchoReply:
-		return time.Since(start), nil
-	default:
-		return 0, fmt.Errorf("got %+v from %v; want echo reply or extended echo reply", rm, peer)
+	if stats.Received == 0 {
+		return 0, fmt.Errorf("no echo reply from %v", stats.Addr)
 	}
+	return stats.RTTs[0], nil
 }
 
 func PingContext(ctx context.Context, addr string) (time.Duration, error) {
@@ -0,0 +1,234 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// checksumOK verifies the Internet checksum (RFC 1071) of b.
+func checksumOK(b []byte) bool {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return s == 0xffff
+}
+
+func TestMarshalGolden(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("HELLO-R-U-THERE"), // odd length
+		bytes.Repeat([]byte("Go Go Gadget Ping!!!"), 3),
+	} {
+		got, err := (&icmpMessage{
+			Type: icmpv4EchoRequest,
+			Body: &icmpEcho{ID: 0x1234, Seq: 0x5678, Data: data},
+		}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Compare against golang.org/x/net/icmp as the reference encoder.
+		want, err := (&icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: 0x1234, Seq: 0x5678, Data: data},
+		}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Marshal(data=%q) = %x, want %x", data, got, want)
+		}
+		if !checksumOK(got) {
+			t.Errorf("Marshal(data=%q): invalid checksum in %x", data, got)
+		}
+	}
+}
+
+func TestParseICMPMessage(t *testing.T) {
+	b := []byte{
+		icmpv4EchoReply, 0, 0xc5, 0x7b, // type, code, checksum
+		0x12, 0x34, // id
+		0x00, 0x01, // seq
+		'h', 'i',
+	}
+	m, err := parseICMPMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Type, icmpv4EchoReply; got != want {
+		t.Errorf("unexpected type: got %d, want %d", got, want)
+	}
+	if got, want := m.Checksum, 0xc57b; got != want {
+		t.Errorf("unexpected checksum: got %#x, want %#x", got, want)
+	}
+	echo, ok := m.Body.(*icmpEcho)
+	if !ok {
+		t.Fatalf("unexpected body type %T", m.Body)
+	}
+	if echo.ID != 0x1234 || echo.Seq != 1 || string(echo.Data) != "hi" {
+		t.Errorf("unexpected echo body: %+v", echo)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{icmpv4EchoReply},
+		{icmpv4EchoReply, 0, 0},
+		{icmpv4EchoReply, 0, 0, 0, 0x12},
+		{icmpv4EchoReply, 0, 0, 0, 0x12, 0x34, 0x00},
+	} {
+		if _, err := parseICMPMessage(b); err == nil {
+			t.Errorf("parseICMPMessage(%x) unexpectedly succeeded", b)
+		}
+	}
+}
+
+func TestIPv4Payload(t *testing.T) {
+	// IHL of 15 (60 bytes) in a 20-byte buffer must not panic.
+	b := append([]byte{0x4f}, make([]byte, 19)...)
+	if got := ipv4Payload(b); len(got) != len(b) {
+		t.Errorf("ipv4Payload(truncated) = %d bytes, want %d", len(got), len(b))
+	}
+}
+
+func FuzzParseICMPMessage(f *testing.F) {
+	f.Add([]byte{icmpv4EchoReply, 0, 0xc5, 0x7b, 0x12, 0x34, 0x00, 0x01, 'h', 'i'})
+	f.Add([]byte{icmpv4EchoReply, 0, 0, 0, 0x12})
+	f.Add([]byte{3, 1, 0, 0}) // destination unreachable
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := parseICMPMessage(b)
+		if err != nil {
+			return
+		}
+		echo, ok := m.Body.(*icmpEcho)
+		if !ok {
+			return
+		}
+		// Round-trip: re-encoding the parsed message must reproduce the
+		// input, modulo the checksum.
+		out, err := (&icmpMessage{Type: m.Type, Code: m.Code, Body: echo}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out[4:], b[4:]) {
+			t.Errorf("round-trip mismatch: got %x, want %x", out[4:], b[4:])
+		}
+	})
+}
+
+func FuzzParseICMPEcho(f *testing.F) {
+	f.Add([]byte{0x12, 0x34, 0x00, 0x01})
+	f.Add([]byte{0x12, 0x34, 0x00})
+	f.Add([]byte("Go Go Gadget Ping!!!"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := parseICMPEcho(b)
+		if err != nil {
+			if len(b) >= 4 {
+				t.Errorf("parseICMPEcho(%x) = %v for a body of %d bytes", b, err, len(b))
+			}
+			return
+		}
+		out, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Errorf("round-trip mismatch: got %x, want %x", out, b)
+		}
+	})
+}
+
+func TestPingUnprivilegedDeadlineExceeded(t *testing.T) {
+	ctx, canc := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer canc()
+	if _, err := PingUnprivileged(ctx, "127.0.0.1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PingUnprivileged(expired ctx) = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	// The summaries were computed from the per-packet times like iputils
+	// ping(8) computes its summary, i.e. in integer microseconds, hence the
+	// tolerance of 1µs. For averages which are not an integer number of
+	// microseconds, ping(8) reports a slightly wrong mdev, so the examples
+	// avoid them.
+	for _, tt := range []struct {
+		desc     string
+		sent     int
+		times    []string // time= of each reply, in ms
+		rttLine  string   // min/avg/max/mdev, in ms
+		wantLoss float64
+	}{
+		{
+			desc:     "localhost",
+			sent:     4,
+			times:    []string{"0.045", "0.052", "0.038", "0.049"},
+			rttLine:  "0.038/0.046/0.052/0.005",
+			wantLoss: 0,
+		},
+		{
+			desc:     "wifi",
+			sent:     10,
+			times:    []string{"3.412", "5.871", "2.904", "14.530", "3.118", "4.775", "2.966"},
+			rttLine:  "2.904/5.368/14.530/3.878",
+			wantLoss: 0.3,
+		},
+		{
+			desc:     "single reply",
+			sent:     1,
+			times:    []string{"0.812"},
+			rttLine:  "0.812/0.812/0.812/0.000",
+			wantLoss: 0,
+		},
+		{
+			desc:     "unreachable",
+			sent:     3,
+			rttLine:  "0/0/0/0",
+			wantLoss: 1,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := Statistics{Sent: tt.sent}
+			for _, ms := range tt.times {
+				rtt, err := time.ParseDuration(ms + "ms")
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.add(rtt)
+			}
+			if got := s.PacketLoss(); math.Abs(got-tt.wantLoss) > 1e-9 {
+				t.Errorf("PacketLoss() = %v, want %v", got, tt.wantLoss)
+			}
+			fields := strings.Split(tt.rttLine, "/")
+			for idx, got := range []time.Duration{s.Min, s.Avg, s.Max, s.Mdev} {
+				want, err := time.ParseDuration(fields[idx] + "ms")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := got - want; diff < -time.Microsecond || diff > time.Microsecond {
+					t.Errorf("%s = %v, want %v", []string{"min", "avg", "max", "mdev"}[idx], got, want)
+				}
+			}
+		})
+	}
+
+	if got := (&Statistics{}).PacketLoss(); got != 0 {
+		t.Errorf("PacketLoss() without echo requests = %v, want 0", got)
+	}
+}
@@ -0,0 +1,157 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	protocolICMP     = 1  // iana.ProtocolICMP
+	protocolIPv6ICMP = 58 // iana.ProtocolIPv6ICMP
+)
+
+// Pinger sends ICMP echo requests (IPv4 or IPv6) and collects round trip time
+// statistics. The zero value sends a single echo request over an unprivileged
+// ICMP socket and waits up to 5 seconds for the reply.
+type Pinger struct {
+	// Count is the number of echo requests to send (default 1).
+	Count int
+
+	// Interval is the time between sending echo requests (default 1s).
+	Interval time.Duration
+
+	// Timeout is how long to wait for each echo reply (default 5s).
+	Timeout time.Duration
+
+	// Privileged selects raw ICMP sockets, which require CAP_NET_RAW. By
+	// default, unprivileged ICMP datagram sockets are used, which require
+	// the group of the process to be listed in the net.ipv4.ping_group_range
+	// sysctl.
+	Privileged bool
+}
+
+// Statistics describes the result of pinging a host.
+type Statistics struct {
+	Addr     net.IP
+	Sent     int
+	Received int
+
+	// RTTs contains the round trip times of all received echo replies.
+	RTTs []time.Duration
+
+	Min, Avg, Max time.Duration
+	// Mdev is the standard deviation of RTTs (like ping(8) reports it).
+	Mdev time.Duration
+}
+
+// PacketLoss returns the fraction (0 to 1) of echo requests which were not
+// answered.
+func (s *Statistics) PacketLoss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+func (s *Statistics) String() string {
+	return fmt.Sprintf("%v: %d packets transmitted, %d received, %.0f%% packet loss, rtt min/avg/max/mdev = %v/%v/%v/%v",
+		s.Addr, s.Sent, s.Received, 100*s.PacketLoss(), s.Min, s.Avg, s.Max, s.Mdev)
+}
+
+func (s *Statistics) add(rtt time.Duration) {
+	s.Received++
+	s.RTTs = append(s.RTTs, rtt)
+	if s.Min == 0 || rtt < s.Min {
+		s.Min = rtt
+	}
+	if rtt > s.Max {
+		s.Max = rtt
+	}
+	var sum, sum2 float64
+	for _, d := range s.RTTs {
+		sum += float64(d)
+		sum2 += float64(d) * float64(d)
+	}
+	n := float64(len(s.RTTs))
+	avg := sum / n
+	s.Avg = time.Duration(avg)
+	s.Mdev = time.Duration(math.Sqrt(math.Max(0, sum2/n-avg*avg)))
+}
+
+// resolve returns the first IP address of host, preferring IPv4.
+func resolve(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("Lookup(%v) = no IPs", host)
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// Ping sends p.Count echo requests to host and returns the statistics. An error
+// is only returned when the echo requests could not be sent (e.g. host cannot
+// be resolved, or ctx was canceled); unanswered echo requests are reported as
+// packet loss.
+func (p *Pinger) Ping(ctx context.Context, host string) (*Statistics, error) {
+	count := p.Count
+	if count == 0 {
+		count = 1
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = 1 * time.Second
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ip, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := getSocket(ip.To4() == nil, p.Privileged)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Statistics{Addr: ip}
+	for i := range count {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		stats.Sent++
+		rtt, err := sock.roundTrip(ctx, ip, timeout)
+		if err == errLost {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.add(rtt)
+	}
+	return stats, nil
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
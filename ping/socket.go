@@ -0,0 +1,211 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// errLost is returned by roundTrip when no reply arrived in time.
+var errLost = errors.New("no echo reply received")
+
+// echoKey identifies an outstanding echo request.
+type echoKey struct {
+	id, seq int
+}
+
+type echoReply struct {
+	received time.Time
+	err      error
+}
+
+type pendingEcho struct {
+	peer  net.IP
+	reply chan echoReply
+}
+
+// socket is an ICMP socket which is shared by all pings of this process, so
+// that concurrent pings neither race on state nor steal each other’s replies:
+// a single reader goroutine dispatches replies by (ID, Seq).
+type socket struct {
+	network    string
+	proto      int
+	privileged bool
+	reqType    icmp.Type
+	replyType  icmp.Type
+	conn       net.PacketConn // *icmp.PacketConn, except in tests
+
+	// id is the ICMP echo identifier. For unprivileged (datagram) sockets, the
+	// kernel replaces the identifier with the local port of the socket.
+	id  int
+	seq atomic.Uint32
+
+	mu      sync.Mutex
+	pending map[echoKey]pendingEcho
+}
+
+var (
+	socketsMu sync.Mutex
+	sockets   = make(map[string]*socket) // keyed by network
+)
+
+// getSocket returns the shared socket for the specified IP version and socket
+// type, opening it (and starting its reader goroutine) on first use.
+func getSocket(v6, privileged bool) (*socket, error) {
+	s := &socket{
+		network:    "udp4",
+		proto:      protocolICMP,
+		privileged: privileged,
+		reqType:    ipv4.ICMPTypeEcho,
+		replyType:  ipv4.ICMPTypeEchoReply,
+		pending:    make(map[echoKey]pendingEcho),
+	}
+	laddr := "0.0.0.0"
+	if v6 {
+		s.network, s.proto, laddr = "udp6", protocolIPv6ICMP, "::"
+		s.reqType, s.replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	if privileged {
+		s.network = "ip4:icmp"
+		if v6 {
+			s.network = "ip6:ipv6-icmp"
+		}
+	}
+
+	socketsMu.Lock()
+	defer socketsMu.Unlock()
+	if existing, ok := sockets[s.network]; ok {
+		return existing, nil
+	}
+	conn, err := icmp.ListenPacket(s.network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	s.id = os.Getpid() & 0xffff
+	if !privileged {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			s.id = addr.Port
+		}
+	}
+	sockets[s.network] = s
+	go s.readLoop()
+	return s, nil
+}
+
+// readLoop dispatches echo replies to the pending roundTrip calls until the
+// socket fails, in which case the socket is discarded (and re-opened by the
+// next getSocket call).
+func (s *socket) readLoop() {
+	rb := make([]byte, 1500)
+	for {
+		n, peer, err := s.conn.ReadFrom(rb)
+		received := time.Now()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		rm, err := icmp.ParseMessage(s.proto, rb[:n])
+		if err != nil {
+			continue // malformed, not for us
+		}
+		echo, ok := rm.Body.(*icmp.Echo)
+		if rm.Type != s.replyType || !ok {
+			// Raw sockets receive all ICMP messages, e.g. our own echo
+			// requests when pinging localhost.
+			continue
+		}
+		key := echoKey{id: echo.ID, seq: echo.Seq}
+		s.mu.Lock()
+		p, ok := s.pending[key]
+		if ok && p.peer.Equal(peerIP(peer)) {
+			delete(s.pending, key)
+			p.reply <- echoReply{received: received}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *socket) fail(err error) {
+	socketsMu.Lock()
+	if sockets[s.network] == s {
+		delete(sockets, s.network)
+	}
+	socketsMu.Unlock()
+	s.conn.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, p := range s.pending {
+		delete(s.pending, key)
+		p.reply <- echoReply{err: fmt.Errorf("reading from ICMP socket: %v", err)}
+	}
+}
+
+// roundTrip sends an echo request to ip and waits for the matching reply,
+// returning errLost if none arrives within timeout.
+func (s *socket) roundTrip(ctx context.Context, ip net.IP, timeout time.Duration) (time.Duration, error) {
+	reply := make(chan echoReply, 1)
+	var key echoKey
+	s.mu.Lock()
+	for {
+		// Sequence numbers wrap around after 65536 echo requests; skip
+		// sequence numbers which are still in use.
+		key = echoKey{id: s.id, seq: int(uint16(s.seq.Add(1)))}
+		if _, ok := s.pending[key]; !ok {
+			break
+		}
+	}
+	s.pending[key] = pendingEcho{peer: ip, reply: reply}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if p, ok := s.pending[key]; ok && p.reply == reply {
+			delete(s.pending, key)
+		}
+	}()
+
+	wb, err := (&icmp.Message{
+		Type: s.reqType,
+		Body: &icmp.Echo{
+			ID:   key.id,
+			Seq:  key.seq,
+			Data: []byte("HELLO-R-U-THERE"),
+		},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if s.privileged {
+		dst = &net.IPAddr{IP: ip}
+	}
+	start := time.Now()
+	if _, err := s.conn.WriteTo(wb, dst); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-timer.C:
+		return 0, errLost
+	case r := <-reply:
+		if r.err != nil {
+			return 0, r.err
+		}
+		return r.received.Sub(start), nil
+	}
+}
@@ -0,0 +1,212 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+type fakePacket struct {
+	b    []byte
+	peer net.Addr
+}
+
+// fakeConn is a net.PacketConn which answers echo requests to reachable peers
+// after a random delay, i.e. in random order. For other peers, it sends a
+// spoofed reply from a different address, which must be ignored.
+type fakeConn struct {
+	reachable func(ip net.IP) bool
+
+	replies   chan fakePacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	requests []icmp.Echo
+}
+
+func newFakeConn(reachable func(ip net.IP) bool) *fakeConn {
+	return &fakeConn{
+		reachable: reachable,
+		replies:   make(chan fakePacket),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.replies:
+		return copy(b, p.b), p.peer, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	m, err := icmp.ParseMessage(protocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := m.Body.(*icmp.Echo)
+	if m.Type != ipv4.ICMPTypeEcho || !ok {
+		return 0, errors.New("not an echo request")
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, *echo)
+	c.mu.Unlock()
+
+	ip := addr.(*net.UDPAddr).IP
+	peer := ip
+	if !c.reachable(ip) {
+		peer = net.ParseIP("192.0.2.1")
+	}
+	reply, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: echo.Data},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		time.Sleep(rand.N(10 * time.Millisecond))
+		select {
+		case c.replies <- fakePacket{b: reply, peer: &net.UDPAddr{IP: peer}}:
+		case <-c.closed:
+		}
+	}()
+	return len(b), nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr              { return &net.UDPAddr{} }
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func newTestSocket(conn net.PacketConn) *socket {
+	s := &socket{
+		network:   "test",
+		proto:     protocolICMP,
+		reqType:   ipv4.ICMPTypeEcho,
+		replyType: ipv4.ICMPTypeEchoReply,
+		conn:      conn,
+		id:        0x1234,
+		pending:   make(map[echoKey]pendingEcho),
+	}
+	go s.readLoop()
+	return s
+}
+
+func TestRoundTripConcurrent(t *testing.T) {
+	// Peers with an even last octet are reachable.
+	conn := newFakeConn(func(ip net.IP) bool { return ip.To4()[3]%2 == 0 })
+	s := newTestSocket(conn)
+	defer conn.Close()
+
+	const pings = 200
+	var wg sync.WaitGroup
+	errs := make([]error, pings)
+	for i := range pings {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := net.IPv4(10, 0, byte(i/256), byte(i%256))
+			_, errs[i] = s.roundTrip(context.Background(), ip, 1*time.Second)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if reachable := i%2 == 0; reachable && err != nil {
+			t.Errorf("ping %d (reachable): %v", i, err)
+		} else if !reachable && err != errLost {
+			t.Errorf("ping %d (unreachable): got %v, want %v", i, err, errLost)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		t.Errorf("%d echo requests still pending", len(s.pending))
+	}
+}
+
+func TestRoundTripSeqWrapAround(t *testing.T) {
+	conn := newFakeConn(func(net.IP) bool { return true })
+	s := newTestSocket(conn)
+	defer conn.Close()
+
+	// Sequence numbers 65535 and 0 are still in use by other pings.
+	other := make(chan echoReply, 2)
+	s.seq.Store(65534)
+	s.mu.Lock()
+	s.pending[echoKey{id: s.id, seq: 65535}] = pendingEcho{peer: net.IPv4(10, 0, 0, 1), reply: other}
+	s.pending[echoKey{id: s.id, seq: 0}] = pendingEcho{peer: net.IPv4(10, 0, 0, 1), reply: other}
+	s.mu.Unlock()
+
+	if _, err := s.roundTrip(context.Background(), net.IPv4(10, 0, 0, 2), 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.requests) != 1 {
+		t.Fatalf("got %d echo requests, want 1", len(conn.requests))
+	}
+	if got, want := conn.requests[0].Seq, 1; got != want {
+		t.Errorf("echo request has seq %d, want %d", got, want)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) != 2 {
+		t.Errorf("pending echo requests of other pings were modified: %v", s.pending)
+	}
+}
+
+func TestSocketFail(t *testing.T) {
+	// Nobody replies, so only fail unblocks the waiters.
+	conn := newFakeConn(func(net.IP) bool { return false })
+	conn.replies = nil
+	s := newTestSocket(conn)
+
+	const pings = 10
+	errc := make(chan error, pings)
+	for i := range pings {
+		go func() {
+			_, err := s.roundTrip(context.Background(), net.IPv4(10, 0, 0, byte(i)), time.Hour)
+			errc <- err
+		}()
+	}
+	// Wait until all echo requests were sent.
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		s.mu.Unlock()
+		if n == pings {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.Close() // makes readLoop call fail
+	for range pings {
+		select {
+		case err := <-errc:
+			if err == nil || !strings.Contains(err.Error(), "reading from ICMP socket") {
+				t.Errorf("roundTrip = %v, want read error", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("roundTrip still blocked after the socket failed")
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"sort"
 	"strings"
 	"time"
 
@@ -230,13 +229,22 @@ h1 {
 </div>
 
 <script>
-const PHASES = [
+const BASE_PHASES = [
   { name: 'checking', label: 'Checking' },
   { name: 'waking', label: 'Waking' },
-  { name: 'ssh', label: 'Waiting for SSH' },
-  { name: 'health', label: 'Health check' }
+  { name: 'ssh', label: 'Waiting for SSH' }
 ];
 
+// Readiness probes are reported as additional phases named health/<probe>,
+// which are appended as they arrive.
+let PHASES = BASE_PHASES.slice();
+
+function addPhase(name) {
+  if (name === 'complete' || PHASES.some(p => p.name === name)) return;
+  const label = name.startsWith('health/') ? 'Health: ' + name.slice('health/'.length) : name;
+  PHASES.push({ name: name, label: label });
+}
+
 const SPINNER = ['◐', '◓', '◑', '◒'];
 
 let eventSource = null;
@@ -286,6 +294,7 @@ function updateTotal(done) {
 }
 
 function resetState() {
+  PHASES = BASE_PHASES.slice();
   phaseState = {};
   spinnerFrame = 0;
   startTime = Date.now();
@@ -313,6 +322,7 @@ function startWake(machine) {
     const event = JSON.parse(e.data);
 
     if (event.phase !== 'complete') {
+      addPhase(event.phase);
       phaseState[event.phase] = {
         status: event.status,
         detail: event.detail || '',
@@ -395,14 +405,13 @@ var hostname = func() string {
 }()
 
 func (s *server) index(w http.ResponseWriter, r *http.Request) error {
-	filtered := make([]string, 0, len(wake.Hosts))
-	for _, host := range wake.Hosts {
+	var filtered []string
+	for _, host := range wake.Hosts() {
 		if host.Relay != hostname {
 			continue
 		}
 		filtered = append(filtered, host.Name)
 	}
-	sort.Strings(filtered)
 	var buf bytes.Buffer
 	if err := indexTmpl.Execute(&buf, struct {
 		Machines []string
@@ -428,7 +437,7 @@ func (s *server) wake(w http.ResponseWriter, r *http.Request) error {
 
 	log.Printf("wake(%s)", host)
 
-	target, ok := wake.Hosts[host]
+	target, ok := wake.LookupHost(host)
 	if !ok {
 		return httpError(http.StatusNotFound, fmt.Errorf("host not found"))
 	}
@@ -465,7 +474,7 @@ func (s *server) wol(w http.ResponseWriter, r *http.Request) error {
 
 	log.Printf("wol(%s)", host)
 
-	target, ok := wake.Hosts[host]
+	target, ok := wake.LookupHost(host)
 	if !ok {
 		return httpError(http.StatusNotFound, fmt.Errorf("host not found"))
 	}
@@ -498,7 +507,7 @@ func (s *server) pollSSH(w http.ResponseWriter, r *http.Request) error {
 
 	log.Printf("pollSSH(%s)", host)
 
-	target, ok := wake.Hosts[host]
+	target, ok := wake.LookupHost(host)
 	if !ok {
 		return httpError(http.StatusNotFound, fmt.Errorf("host not found"))
 	}
@@ -570,7 +579,7 @@ func (s *server) wakeStream(w http.ResponseWriter, r *http.Request) error {
 
 	log.Printf("wakeStream(%s)", host)
 
-	target, ok := wake.Hosts[host]
+	target, ok := wake.LookupHost(host)
 	if !ok {
 		return httpError(http.StatusNotFound, fmt.Errorf("host not found"))
 	}
@@ -652,10 +661,17 @@ func webwake() error {
 		listenAddr = flag.String("listen",
 			"localhost:8911,consrv.lan:8911",
 			"(comma-separated list of) [host]:port HTTP listen address(es)")
+		hostsFile = flag.String("hosts_file",
+			"/perm/wake-hosts.json",
+			"host inventory file (JSON), re-loaded on SIGHUP; the built-in inventory is used if it does not exist")
 	)
 
 	flag.Parse()
 
+	if err := wake.LoadHostsAndWatch(*hostsFile); err != nil {
+		return err
+	}
+
 	// WaitForClock also (indirectly) ensures the network is up.
 	gokrazy.WaitForClock()
 